@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"sample-controller/pkg/controller"
 	"sample-controller/pkg/kubeapi"
 	"sample-controller/pkg/ratelimit"
+	"time"
 )
 
 func main() {
@@ -30,7 +32,12 @@ func main() {
 		panic(err)
 	}
 
-	controller := controller.NewController(client, ratelimit.AfterOneSecondIdle(), "default")
+	// Mirrors client-go's workqueue.DefaultControllerRateLimiter: a
+	// 10qps/100 burst token bucket combined with a per-key exponential
+	// backoff with a 5ms base delay, capped at 1000s.
+	rl := ratelimit.New(10, 100, 5*time.Millisecond, 1000*time.Second)
+	controller := controller.NewController(context.Background(), client, rl, "default",
+		controller.DefaultControllerOptions())
 
 	done := make(chan struct{})
 	go func() {
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"fmt"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -8,22 +9,31 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"log"
+	"reflect"
 	"sample-controller/pkg/kubeapi"
 	"sample-controller/pkg/ratelimit"
+	"sync"
+	"time"
 )
 
 const Version = "v1alpha1"
 const Group = "samplecontroller.example.com"
 const Kind = "Foo"
 
-func addCRD(client *kubeapi.KubeClient, spec apiextensionsv1.CustomResourceDefinitionSpec) error {
+// addCRD registers spec with the API server and waits for it to
+// become Established, giving up after establishTimeout.
+func addCRD(ctx context.Context, client kubeapi.KubeClient,
+	spec apiextensionsv1.CustomResourceDefinitionSpec, establishTimeout time.Duration) error {
 	name := spec.Names.Plural + "." + spec.Group
 	crd := apiextensionsv1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{Name: name},
 		Spec:       spec,
 	}
 
-	err := client.AddCustomResourceDefinition(&crd)
+	ctx, cancel := context.WithTimeout(ctx, establishTimeout)
+	defer cancel()
+
+	err := client.AddCustomResourceDefinition(ctx, &crd)
 
 	// Ignore 409 (Conflict)
 	// FIXME: Update with a PUT with a metadata.resourceVersion.
@@ -31,28 +41,35 @@ func addCRD(client *kubeapi.KubeClient, spec apiextensionsv1.CustomResourceDefin
 		return re
 	}
 
-	resources, stop := client.GetCustomResourceDefinitions(name)
+	resources, stop := client.GetCustomResourceDefinitions(ctx, name)
 	defer close(stop)
-Outer:
-	for res := range resources {
-		if res.Err != nil {
-			return res.Err
-		}
-		if res.IsDelete {
-			continue
-		}
-		item := res.Item.(apiextensionsv1.CustomResourceDefinition)
-		for _, cond := range item.Status.Conditions {
-			if cond.Type == "Established" &&
-				cond.Status == apiextensionsv1.ConditionTrue {
-				break Outer
+	for {
+		select {
+		case res, ok := <-resources:
+			if !ok {
+				return fmt.Errorf("watch for CRD %s closed before it became established", name)
 			}
+			if res.Err != nil {
+				return res.Err
+			}
+			if res.IsDelete {
+				continue
+			}
+			item := res.Item.(apiextensionsv1.CustomResourceDefinition)
+			for _, cond := range item.Status.Conditions {
+				if cond.Type == "Established" &&
+					cond.Status == apiextensionsv1.ConditionTrue {
+					return nil
+				}
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for CRD %s to become established: %w",
+				name, ctx.Err())
 		}
 	}
-	return nil
 }
 
-func addFooCRD(client *kubeapi.KubeClient) error {
+func addFooCRD(ctx context.Context, client kubeapi.KubeClient, establishTimeout time.Duration) error {
 	crdNames := apiextensionsv1.CustomResourceDefinitionNames{
 		Kind:   Kind,
 		Plural: "foos",
@@ -64,15 +81,40 @@ func addFooCRD(client *kubeapi.KubeClient) error {
 			"replicas":       apiextensionsv1.JSONSchemaProps{Type: "integer"},
 		},
 	}
+	crdConditionSchema := apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"type":    apiextensionsv1.JSONSchemaProps{Type: "string"},
+			"status":  apiextensionsv1.JSONSchemaProps{Type: "string"},
+			"reason":  apiextensionsv1.JSONSchemaProps{Type: "string"},
+			"message": apiextensionsv1.JSONSchemaProps{Type: "string"},
+		},
+	}
+	crdStatusSchema := apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"availableReplicas": apiextensionsv1.JSONSchemaProps{Type: "integer"},
+			"conditions": apiextensionsv1.JSONSchemaProps{
+				Type:  "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &crdConditionSchema},
+			},
+		},
+	}
 	crdSchema := &apiextensionsv1.JSONSchemaProps{
-		Type:       "object",
-		Properties: map[string]apiextensionsv1.JSONSchemaProps{"spec": crdSchemaSpec},
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"spec":   crdSchemaSpec,
+			"status": crdStatusSchema,
+		},
 	}
 	crdVersion := apiextensionsv1.CustomResourceDefinitionVersion{
 		Name:    Version,
 		Schema:  &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: crdSchema},
 		Served:  true,
 		Storage: true,
+		Subresources: &apiextensionsv1.CustomResourceSubresources{
+			Status: &apiextensionsv1.CustomResourceSubresourceStatus{},
+		},
 	}
 	crdSpec := apiextensionsv1.CustomResourceDefinitionSpec{
 		Group:    Group,
@@ -80,7 +122,7 @@ func addFooCRD(client *kubeapi.KubeClient) error {
 		Scope:    "Namespaced",
 		Versions: []apiextensionsv1.CustomResourceDefinitionVersion{crdVersion},
 	}
-	return addCRD(client, crdSpec)
+	return addCRD(ctx, client, crdSpec, establishTimeout)
 }
 
 type FooSpec struct {
@@ -88,9 +130,49 @@ type FooSpec struct {
 	Replicas       int32  `json:"replicas"`
 }
 
+// FooCondition is a single observation about a Foo, identified by Type
+// ("Ready" for now). Reason is a short, machine readable explanation
+// for the current Status, set when Status is not "True".
+type FooCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type FooStatus struct {
+	AvailableReplicas int32          `json:"availableReplicas"`
+	Conditions        []FooCondition `json:"conditions,omitempty"`
+}
+
 type Foo struct {
 	metav1.ObjectMeta `json:"metadata"`
-	Spec              FooSpec `json:"spec"`
+	Spec              FooSpec   `json:"spec"`
+	Status            FooStatus `json:"status"`
+}
+
+// ControllerOptions bounds how long the controller waits on
+// individual operations, so a slow or unreachable API server does not
+// hang it forever. Running out of EstablishTimeout ends the controller
+// with an error on Errors; a call that runs out of SyncTimeout is
+// logged and retried like any other failed synchronization, and is not
+// sent on Errors.
+type ControllerOptions struct {
+	// EstablishTimeout bounds how long addCRD waits for the Foo CRD
+	// to become Established.
+	EstablishTimeout time.Duration
+	// SyncTimeout bounds each AddDeployment/UpdateDeployment call
+	// processOneItem makes while synchronizing a single Foo.
+	SyncTimeout time.Duration
+}
+
+// DefaultControllerOptions returns the ControllerOptions used by
+// main: 30s to establish the CRD, 30s per synchronization call.
+func DefaultControllerOptions() ControllerOptions {
+	return ControllerOptions{
+		EstablishTimeout: 30 * time.Second,
+		SyncTimeout:      30 * time.Second,
+	}
 }
 
 type Controller struct {
@@ -99,19 +181,30 @@ type Controller struct {
 	stopFoos        chan<- struct{}
 	stopDeployments chan<- struct{}
 
+	// ready is closed by startAux once stopFoos/stopDeployments have
+	// their final value (set, if addFooCRD succeeded; left nil,
+	// otherwise), so RequestStop can read them without racing
+	// startAux's goroutine.
+	ready chan struct{}
+
+	ctx  context.Context
+	opts ControllerOptions
+
 	rl ratelimit.RateLimiter
 
-	client *kubeapi.KubeClient
+	client kubeapi.KubeClient
 }
 
 // It is done once c.Errors is closed
 func (c *Controller) RequestStop() {
+	<-c.ready
 	if c.stopFoos != nil {
 		close(c.stopFoos)
 	}
 	if c.stopDeployments != nil {
 		close(c.stopDeployments)
 	}
+	c.rl.Stop()
 }
 
 type controllerStatus struct {
@@ -120,9 +213,6 @@ type controllerStatus struct {
 
 	// Map from the name to deployment
 	deployments map[string]appsv1.Deployment
-
-	// Set of names of Foos we have to check
-	todo map[string]struct{}
 }
 
 func newDeployment(foo *Foo) appsv1.Deployment {
@@ -159,50 +249,82 @@ func newDeployment(foo *Foo) appsv1.Deployment {
 	return ret
 }
 
-func synchronize(client *kubeapi.KubeClient, status *controllerStatus) error {
-	for item := range status.todo {
-		// FIXME: Split a processsOneItem
-		foo, has_foo := status.foos[item]
-		if !has_foo {
-			// There is nothing for us to do. The Kubernetes garbage collector will
-			// delete the deployment for us.
-			delete(status.todo, item)
-			continue
-		}
-
-		dep, has_dep := status.deployments[foo.Spec.DeploymentName]
-		if has_dep {
-			if !metav1.IsControlledBy(&dep, &foo) {
-				log.Printf("Deployment %s:%s is not owned by us.", dep.Namespace,
-					dep.Name)
-				// Don't delete from todo so we try again
-				continue
-			}
-			if foo.Spec.Replicas == *dep.Spec.Replicas {
-				delete(status.todo, item)
-				continue
-			}
-		}
+// processOneItem synchronizes a single Foo, identified by name, with
+// its owned Deployment. retry tells the caller to ask for this item
+// again later even though no error occurred.
+func (c *Controller) processOneItem(status *controllerStatus, name string) (
+	retry bool, err error) {
+	foo, has_foo := status.foos[name]
+	if !has_foo {
+		// There is nothing for us to do. The Kubernetes garbage collector will
+		// delete the deployment for us.
+		return false, nil
+	}
 
-		newDep := newDeployment(&foo)
-		var err error
-		if has_dep {
-			newDep.ResourceVersion = dep.ResourceVersion
-			err = client.UpdateDeployment(&newDep)
-		} else {
-			err = client.AddDeployment(&newDep)
+	dep, has_dep := status.deployments[foo.Spec.DeploymentName]
+	if has_dep {
+		if !metav1.IsControlledBy(&dep, &foo) {
+			log.Printf("Deployment %s:%s is not owned by us.", dep.Namespace, dep.Name)
+			return true, nil
 		}
-		if err != nil {
-			return err
+		if foo.Spec.Replicas == *dep.Spec.Replicas {
+			return false, c.syncFooStatus(&foo, &dep)
 		}
-		delete(status.todo, item)
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.SyncTimeout)
+	defer cancel()
+
+	// FIXME2: What happens if DeploymentName
+	// changes? The original sample controller
+	// just creates a new deployment, that is
+	// almost certenly a bug.
+	newDep := newDeployment(&foo)
+	if has_dep {
+		newDep.ResourceVersion = dep.ResourceVersion
+		return false, c.client.UpdateDeployment(ctx, &newDep)
+	}
+	return false, c.client.AddDeployment(ctx, &newDep)
+}
+
+// fooStatusFor computes the status a Foo should have given the
+// observed status of its owned Deployment: a Ready condition, True
+// only once the Deployment reports enough ready replicas, and the
+// Deployment's AvailableReplicas count.
+func fooStatusFor(foo *Foo, dep *appsv1.Deployment) FooStatus {
+	condition := FooCondition{Type: "Ready", Status: "True"}
+	switch {
+	case dep.Status.ReadyReplicas >= foo.Spec.Replicas:
+		// Ready as is.
+	case dep.Status.Replicas >= foo.Spec.Replicas:
+		condition.Status = "False"
+		condition.Reason = "DeploymentProgressing"
+		condition.Message = "Waiting for the Deployment's Pods to become ready."
+	default:
+		condition.Status = "False"
+		condition.Reason = "DeploymentUnavailable"
+		condition.Message = "The Deployment does not have enough replicas."
+	}
+	return FooStatus{
+		AvailableReplicas: dep.Status.AvailableReplicas,
+		Conditions:        []FooCondition{condition},
+	}
+}
 
-		// FIXME2: What happens if DeploymentName
-		// changes? The original sample controller
-		// just creates a new deployment, that is
-		// almost certenly a bug.
+// syncFooStatus PATCHes foo's status subresource with the status
+// derived from dep, unless it already matches, to avoid update loops.
+func (c *Controller) syncFooStatus(foo *Foo, dep *appsv1.Deployment) error {
+	newStatus := fooStatusFor(foo, dep)
+	if reflect.DeepEqual(foo.Status, newStatus) {
+		return nil
 	}
-	return nil
+	patch := struct {
+		Status FooStatus `json:"status"`
+	}{newStatus}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.SyncTimeout)
+	defer cancel()
+	return c.client.PatchStatus(ctx, Group, Version, foo.Namespace, "foos/"+foo.Name, &patch)
 }
 
 // processResources goes over the existing Foos and Deployments
@@ -214,22 +336,37 @@ func processResources(c *Controller, deploymentsCh <-chan kubeapi.WatchEvent,
 	status := controllerStatus{}
 	status.foos = make(map[string]Foo)
 	status.deployments = make(map[string]appsv1.Deployment)
-	status.todo = make(map[string]struct{})
 
-	addTODO := func(deployment *appsv1.Deployment) {
-		// Only add to TODO if we own it
+	askForOwner := func(deployment *appsv1.Deployment) {
+		// Only ask for the Foo if we own the Deployment.
 		for _, o := range deployment.OwnerReferences {
 			// It is OK to not be supper strict in
 			// here. We will just try to synchronize more
 			// often.
 			if o.Kind == Kind {
-				c.rl.AskTick()
-				status.todo[o.Name] = struct{}{}
+				c.rl.AskTickFor(o.Name)
 				return
 			}
 		}
 	}
 
+	// requestNext arranges for the next ready key, as produced by
+	// c.rl.Get, to show up on readyCh so it can take part in the
+	// select loop below. c.rl.Get blocks, so it needs its own
+	// goroutine; readyCh is buffered so that goroutine never blocks
+	// trying to deliver its result.
+	var readyCh chan string
+	requestNext := func() {
+		readyCh = make(chan string, 1)
+		go func(ch chan<- string) {
+			if key, ok := c.rl.Get(); ok {
+				ch <- key
+			}
+			close(ch)
+		}(readyCh)
+	}
+	requestNext()
+
 	for {
 		select {
 		case d, ok := <-deploymentsCh:
@@ -249,9 +386,9 @@ func processResources(c *Controller, deploymentsCh <-chan kubeapi.WatchEvent,
 				status.deployments[newDeployment.Name] = newDeployment
 			}
 
-			addTODO(&newDeployment)
+			askForOwner(&newDeployment)
 			if ok {
-				addTODO(&oldDeployment)
+				askForOwner(&oldDeployment)
 			}
 
 		case f, ok := <-foosCh:
@@ -264,19 +401,31 @@ func processResources(c *Controller, deploymentsCh <-chan kubeapi.WatchEvent,
 				break
 			}
 			newFoo := f.Item.(Foo)
-			c.rl.AskTick()
 			if f.IsDelete {
 				delete(status.foos, newFoo.Name)
 			} else {
 				status.foos[newFoo.Name] = newFoo
 			}
-			status.todo[newFoo.Name] = struct{}{}
+			c.rl.AskTickFor(newFoo.Name)
 
-		case <-c.rl.GetChan():
-			if err := synchronize(c.client, &status); err != nil {
+		case key, ok := <-readyCh:
+			if !ok {
+				// The RateLimiter was stopped, there is nothing
+				// more to wait for.
+				readyCh = nil
+				break
+			}
+			retry, err := c.processOneItem(&status, key)
+			switch {
+			case err != nil:
 				log.Printf("Synchronize failed, will retry: %s", err)
-				c.rl.AskTick()
+				c.rl.AskTickFor(key)
+			case retry:
+				c.rl.AskTickFor(key)
+			default:
+				c.rl.Forget(key)
 			}
+			requestNext()
 		}
 
 		// We are done if both channels were closed
@@ -286,16 +435,19 @@ func processResources(c *Controller, deploymentsCh <-chan kubeapi.WatchEvent,
 	}
 }
 
-func NewController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
-	namespace string) *Controller {
+func NewController(ctx context.Context, client kubeapi.KubeClient, rl ratelimit.RateLimiter,
+	namespace string, opts ControllerOptions) *Controller {
 	ret := &Controller{}
 
 	errors := make(chan error)
 	ret.Errors = errors
 
+	ret.ctx = ctx
+	ret.opts = opts
 	ret.rl = rl
 	ret.client = client
 	ret.Namespace = namespace
+	ret.ready = make(chan struct{})
 
 	ret.start()
 
@@ -303,22 +455,158 @@ func NewController(client *kubeapi.KubeClient, rl ratelimit.RateLimiter,
 }
 
 func (c *Controller) startAux() {
-	err := addFooCRD(c.client)
+	err := addFooCRD(c.ctx, c.client, c.opts.EstablishTimeout)
 	if err != nil {
+		close(c.ready)
 		c.Errors <- fmt.Errorf("Could not add CRD: %w", err)
 		close(c.Errors)
 		return
 	}
 
-	foosCh, stopFoos := c.client.GetResources(Group, Version, c.Namespace, "foos", nil, Foo{})
+	foosCh, stopFoos := c.client.GetResources(c.ctx, Group, Version, c.Namespace, "foos",
+		kubeapi.ListOptions{}, Foo{})
 	c.stopFoos = stopFoos
 
-	deploymentsCh, stopDeployments := c.client.GetDeployments(c.Namespace)
+	deploymentsCh, stopDeployments := c.client.GetDeployments(c.ctx, c.Namespace, kubeapi.ListOptions{})
 	c.stopDeployments = stopDeployments
 
+	close(c.ready)
 	processResources(c, deploymentsCh, foosCh)
 }
 
 func (c *Controller) start() {
 	go c.startAux()
 }
+
+// LogLine is a single line read from a Pod's log, tagged with which Pod
+// produced it so a caller following several Pods at once can tell them
+// apart.
+type LogLine struct {
+	Pod       string
+	Timestamp time.Time
+	Message   string
+}
+
+// podLogPollInterval is how often StreamFooLogs re-lists Pods matching
+// the Foo's Deployment, to discover replacements for Pods that were
+// deleted or restarted.
+const podLogPollInterval = 10 * time.Second
+
+// StreamFooLogs streams the combined, Pod-tagged logs of every Pod
+// behind the Deployment owned by the Foo named fooName, automatically
+// following replacement Pods as they appear. Close stop to tear down
+// every underlying log stream and stop the returned channel.
+func (c *Controller) StreamFooLogs(fooName string) (<-chan LogLine, chan<- struct{}, error) {
+	selector := "controller=" + fooName
+	pods, err := c.client.ListPods(c.ctx, c.Namespace, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan LogLine)
+	stop := make(chan struct{})
+	go c.streamFooLogs(selector, pods, out, stop)
+	return out, stop, nil
+}
+
+// streamFooLogs owns one goroutine per Pod currently being followed,
+// and periodically re-lists the selector to start new ones and stop
+// ones for Pods that are gone. It also restarts a Pod's log stream if
+// the stream itself ends on its own (e.g. the container restarted)
+// while the Pod is still around, rather than only when the Pod
+// disappears from the selector.
+func (c *Controller) streamFooLogs(selector string, initial []corev1.Pod, out chan<- LogLine,
+	stop <-chan struct{}) {
+	defer close(out)
+
+	streaming := make(map[string]chan struct{})
+	done := make(chan string)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer func() {
+		for _, podStop := range streaming {
+			close(podStop)
+		}
+	}()
+
+	startPod := func(name string) {
+		podStop := make(chan struct{})
+		streaming[name] = podStop
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.streamOnePodLogs(name, out, podStop)
+			// Report back so the reconcile loop can restart the
+			// stream on its next pass, unless it was podStop being
+			// closed (Pod gone, or streamFooLogs itself stopping)
+			// that ended it.
+			select {
+			case done <- name:
+			case <-podStop:
+			case <-stop:
+			}
+		}()
+	}
+	for _, pod := range initial {
+		startPod(pod.Name)
+	}
+
+	ticker := time.NewTicker(podLogPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case name := <-done:
+			delete(streaming, name)
+		case <-ticker.C:
+			pods, err := c.client.ListPods(c.ctx, c.Namespace, selector)
+			if err != nil {
+				// Transient listing errors shouldn't tear down log
+				// streams that are still working; just try again on
+				// the next tick.
+				continue
+			}
+			seen := make(map[string]bool, len(pods))
+			for _, pod := range pods {
+				seen[pod.Name] = true
+				if _, ok := streaming[pod.Name]; !ok {
+					startPod(pod.Name)
+				}
+			}
+			for name, podStop := range streaming {
+				if !seen[name] {
+					close(podStop)
+					delete(streaming, name)
+				}
+			}
+		}
+	}
+}
+
+// streamOnePodLogs follows a single Pod's log and tags each line with
+// its Pod name, until stop is closed or the stream ends on its own
+// (the Pod was deleted, or its container restarted - the poll loop in
+// streamFooLogs notices either case and reconnects as needed).
+func (c *Controller) streamOnePodLogs(podName string, out chan<- LogLine, stop <-chan struct{}) {
+	lines, podStop := c.client.StreamPodLogs(c.ctx, c.Namespace, podName,
+		kubeapi.LogOptions{Follow: true, Timestamps: true})
+	defer close(podStop)
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			select {
+			case out <- LogLine{Pod: podName, Timestamp: line.Timestamp, Message: line.Message}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,21 +1,24 @@
 package controller
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"github.com/jarcoal/httpmock"
 	"io"
-	"io/ioutil"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"log"
 	"net/http"
 	"sample-controller/pkg/kubeapi"
+	"sample-controller/pkg/kubeapi/fake"
 	"strings"
+	"sync"
 	"testing"
 )
 
-func getClient(t *testing.T) (*kubeapi.KubeClient, *httpmock.MockTransport) {
+func getClient(t *testing.T) (*kubeapi.HTTPClient, *httpmock.MockTransport) {
 	server := httpmock.NewMockTransport()
 	client, err := kubeapi.NewClient("", server)
 	if err != nil {
@@ -31,25 +34,76 @@ func addPipeResponder(server *httpmock.MockTransport, path string) io.Writer {
 	return w
 }
 
+// syncBuffer is an io.Writer safe for concurrent use, so tests can read
+// back log messages without racing the goroutine that produces them.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// TakeString returns everything written so far and clears the buffer.
+func (b *syncBuffer) TakeString() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+// testRateLimiter lets the tests fully control when the controller is
+// allowed to process a key, instead of waiting on a real
+// ratelimit.RateLimiter. Like the real RateLimiter, it coalesces
+// AskTickFor calls for a key that is already pending, so the test
+// only has to authorize one Get per distinct piece of work.
 type testRateLimiter struct {
-	ask  chan struct{}
-	tick chan struct{}
+	mu      sync.Mutex
+	pending map[string]bool
+
+	ask    chan string
+	forget chan string
+	get    chan string
 }
 
-func (rl *testRateLimiter) AskTick() {
-	rl.ask <- struct{}{}
+func (rl *testRateLimiter) AskTickFor(key string) {
+	rl.mu.Lock()
+	if rl.pending == nil {
+		rl.pending = make(map[string]bool)
+	}
+	alreadyPending := rl.pending[key]
+	rl.pending[key] = true
+	rl.mu.Unlock()
+
+	if !alreadyPending {
+		rl.ask <- key
+	}
+}
+
+func (rl *testRateLimiter) Forget(key string) {
+	rl.forget <- key
 }
 
-func (rl *testRateLimiter) GetChan() <-chan struct{} {
-	return rl.tick
+func (rl *testRateLimiter) Get() (string, bool) {
+	key, ok := <-rl.get
+	if ok {
+		rl.mu.Lock()
+		delete(rl.pending, key)
+		rl.mu.Unlock()
+	}
+	return key, ok
 }
 
 func (rl *testRateLimiter) Stop() {
 }
 
-func runTestController(client *kubeapi.KubeClient) *Controller {
-	rl := &testRateLimiter{make(chan struct{}), make(chan struct{})}
-	return NewController(client, rl, "default")
+func runTestController(client kubeapi.KubeClient) *Controller {
+	rl := &testRateLimiter{ask: make(chan string), forget: make(chan string), get: make(chan string)}
+	return NewController(context.Background(), client, rl, "default", DefaultControllerOptions())
 }
 
 func TestCreationError(t *testing.T) {
@@ -89,7 +143,7 @@ func TestCreationError(t *testing.T) {
 	if err == nil {
 		t.Error("expected error")
 	} else {
-		expected := "Could not add CRD: Could not decode WatchEvent"
+		expected := "Could not add CRD: Could not decode list of customresourcedefinitions"
 		if !strings.HasPrefix(err.Error(), expected) {
 			t.Error("wrong error", err.Error())
 		}
@@ -140,35 +194,10 @@ func TestCreationError(t *testing.T) {
 	stopController(t, controller)
 }
 
-// FIXME: Create a struct for the return
-func startTestController(t *testing.T) (*Controller,
-	*httpmock.MockTransport, io.Writer, io.Writer) {
-	client, server := getClient(t)
-
-	server.RegisterNoResponder(httpmock.NewNotFoundResponder(t.Fatal))
-
-	json := `{
-			"type": "ADDED",
-			"object": {
-				"status": {
-					"conditions": [{
-						"type": "Established",
-						"status":"True"
-					}]
-				}
-                        }
-		 }`
-
-	server.RegisterResponder("POST", "/apis/apiextensions.k8s.io/v1/customresourcedefinitions", httpmock.NewStringResponder(201, ""))
-	// FIXME: convert all users of =~ to use fixed path, or at least start with ^
-	server.RegisterResponder("GET", "=~apiextensions.k8s.io/v1/customresourcedefinitions.*",
-		httpmock.NewStringResponder(200, json))
-
-	foos := addPipeResponder(server, "=~samplecontroller.example.com/v1alpha1/namespaces/default/foos.*")
-	deployments := addPipeResponder(server, "=~apps/v1/namespaces/default/deployments.*")
+func startTestController(t *testing.T) (*Controller, *fake.Client) {
+	client := fake.New()
 	controller := runTestController(client)
-
-	return controller, server, foos, deployments
+	return controller, client
 }
 
 func stopController(t *testing.T, c *Controller) {
@@ -178,59 +207,40 @@ func stopController(t *testing.T, c *Controller) {
 	}
 }
 
+var errBroken = errors.New("broken")
+
 func TestBrokenFoo(t *testing.T) {
-	controller, _, foos, _ := startTestController(t)
+	controller, client := startTestController(t)
 
-	foos.Write([]byte("broken"))
+	client.PushFoo(kubeapi.WatchEvent{Err: errBroken})
 	if err := <-controller.Errors; err == nil {
 		t.Error("expected error")
-	} else {
-		if !strings.HasPrefix(err.Error(), "Reading Foos: Could not decode WatchEvent") {
-			t.Error("wrong error", err.Error())
-		}
+	} else if !strings.HasPrefix(err.Error(), "Reading Foos: broken") {
+		t.Error("wrong error", err.Error())
 	}
 
 	stopController(t, controller)
 }
 
 func TestBrokenDeployment(t *testing.T) {
-	controller, _, _, deployments := startTestController(t)
+	controller, client := startTestController(t)
 
-	deployments.Write([]byte("broken"))
+	client.PushDeployment(kubeapi.WatchEvent{Err: errBroken})
 	if err := <-controller.Errors; err == nil {
 		t.Error("expected error")
-	} else {
-		if !strings.HasPrefix(err.Error(),
-			"Reading deployments: Could not decode WatchEvent") {
-			t.Error("wrong error", err.Error())
-		}
+	} else if !strings.HasPrefix(err.Error(),
+		"Reading deployments: broken") {
+		t.Error("wrong error", err.Error())
 	}
 
 	stopController(t, controller)
 }
 
-func marshal(t *testing.T, Type string, obj interface{}) []byte {
-	data, err := json.Marshal(obj)
-	if err != nil {
-		t.Fatal("Marhsal failed", err)
-	}
-	we := metav1.WatchEvent{
-		Type:   Type,
-		Object: runtime.RawExtension{Raw: data},
-	}
-	data, err = json.Marshal(&we)
-	if err != nil {
-		t.Fatal("Marhsal failed", err)
-	}
-	return data
-}
-
 func TestFoo(t *testing.T) {
-	r, w := io.Pipe()
-	log.SetOutput(w)
-	var buf [1024]byte
+	logBuf := &syncBuffer{}
+	log.SetOutput(logBuf)
 
-	controller, server, foos, deployments := startTestController(t)
+	controller, client := startTestController(t)
 	rl := controller.rl.(*testRateLimiter)
 
 	foo := Foo{
@@ -245,25 +255,17 @@ func TestFoo(t *testing.T) {
 		},
 	}
 
-	deployment := appsv1.Deployment{}
+	var deployment appsv1.Deployment
 	deploymentOK := make(chan struct{})
 
-	checkDeployment := func(req *http.Request) (*http.Response, error) {
-		data, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			t.Fatal("Could not read request body: ", err)
-		}
-		err = json.Unmarshal(data, &deployment)
-		if err != nil {
-			t.Fatal("Could not unmarshal deployment: ", err)
+	checkDeployment := func(dep *appsv1.Deployment) error {
+		if dep.Namespace != foo.Namespace {
+			t.Error("Wrong namespace: ", dep.Namespace)
 		}
-		if deployment.Namespace != foo.Namespace {
-			t.Error("Wrong namespace: ", deployment.Namespace)
+		if len(dep.OwnerReferences) != 1 {
+			t.Error("Wrong OwnerReferences: ", dep.OwnerReferences)
 		}
-		if len(deployment.OwnerReferences) != 1 {
-			t.Error("Wrong OwnerReferences: ", deployment.OwnerReferences)
-		}
-		owner := deployment.OwnerReferences[0]
+		owner := dep.OwnerReferences[0]
 		if owner.APIVersion != Group+"/"+Version {
 			t.Error("Wrong APIVersion: ", owner.APIVersion)
 		}
@@ -282,7 +284,7 @@ func TestFoo(t *testing.T) {
 		if !*owner.BlockOwnerDeletion {
 			t.Error("Owner doesn't block deletion")
 		}
-		spec := deployment.Spec
+		spec := dep.Spec
 		if *spec.Replicas != foo.Spec.Replicas {
 			t.Error("Wrong repilca number: ", *spec.Replicas)
 		}
@@ -307,108 +309,106 @@ func TestFoo(t *testing.T) {
 			t.Error("Wrong container image: ", containers[0].Image)
 		}
 
+		deployment = *dep
 		deploymentOK <- struct{}{}
 
 		if *spec.Replicas == 3 {
-			return httpmock.NewStringResponse(401, "3 is not OK"), nil
+			return &kubeapi.RequestError{StatusCode: 401, Body: []byte("3 is not OK")}
 		}
-		return httpmock.NewStringResponse(201, ""), nil
+		return nil
 	}
-
-	server.RegisterResponder("POST", "/apis/apps/v1/namespaces/xyz/deployments", checkDeployment)
-
-	foos.Write(marshal(t, "ADDED", &foo))
-
+	client.AddDeploymentFunc = checkDeployment
+	client.UpdateDeploymentFunc = checkDeployment
+
+	client.PushFoo(kubeapi.WatchEvent{Item: foo})
+
+	// step authorizes the controller to work on the next requested key
+	// and waits for it to be either forgotten or re-asked before
+	// returning, forwarding a deploymentOK handshake along the way if
+	// one happens first. Waiting for that confirmation guarantees the
+	// controller has already read whatever state existed when step was
+	// called, so the caller can safely mutate that state afterwards.
+	// pendingKey carries a key from one step to the next when the
+	// controller asked to retry it directly (no Deployment handshake in
+	// between), since that Ask is the only signal of it and must not be
+	// dropped on the floor.
+	var pendingKey string
 	step := func() {
-		// Wait for the controller to ask at least once
-		<-rl.ask
-
-		// Authorize the controller to continue. We still have to keep an eye on rl.ask.
-	loop:
-		for {
-			select {
-			case rl.tick <- struct{}{}:
-				break loop
-			case <-rl.ask:
+		key := pendingKey
+		pendingKey = ""
+
+		// Wait for the controller to ask, discarding any Forget calls
+		// left over from the previous step.
+		if key == "" {
+		wait:
+			for {
+				select {
+				case key = <-rl.ask:
+					break wait
+				case <-rl.forget:
+				}
 			}
 		}
 
-		// If the controller issued more requests, clear them.
-		for {
-			select {
-			case <-rl.ask:
-			default:
-				return
-			}
+		rl.get <- key
+		select {
+		case <-deploymentOK:
+		case <-rl.forget:
+		case pendingKey = <-rl.ask:
 		}
 	}
 	step()
-	<-deploymentOK
-
-	deployments.Write(marshal(t, "ADDED", &deployment))
 
+	// The API server echoes back the Deployment just created.
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment})
 	step()
 
-	server.RegisterResponder("PUT",
-		"/apis/apps/v1/namespaces/xyz/deployments/"+foo.Spec.DeploymentName, checkDeployment)
-
 	foo.Spec.Replicas = 3
-	foos.Write(marshal(t, "ADDED", &foo))
+	client.PushFoo(kubeapi.WatchEvent{Item: foo})
 	step()
-	<-deploymentOK
-	n, err := r.Read(buf[:])
-	data := buf[:n]
+	data := logBuf.TakeString()
 	expected := `Synchronize failed, will retry: http request failed: code=401 body="3 is not OK"\n`
-	if strings.HasSuffix(string(data), expected) {
-		t.Errorf("wrong warning: '%s'", string(data))
+	if strings.HasSuffix(data, expected) {
+		t.Errorf("wrong warning: '%s'", data)
 	}
 	// Test retry
 	step()
-	<-deploymentOK
-	n, err = r.Read(buf[:])
-	data = buf[:n]
-	if strings.HasSuffix(string(data), expected) {
-		t.Errorf("wrong warning: '%s'", string(data))
+	data = logBuf.TakeString()
+	if strings.HasSuffix(data, expected) {
+		t.Errorf("wrong warning: '%s'", data)
 	}
 
-	// The second failure synchronization has requested another tick
-	<-rl.ask
-
+	// The second failure synchronization has requested another retry;
+	// the next step() picks it up below.
 	foo.Spec.Replicas = 2
-	foos.Write(marshal(t, "ADDED", &foo))
+	client.PushFoo(kubeapi.WatchEvent{Item: foo})
 	step()
-	<-deploymentOK
-	deployments.Write(marshal(t, "ADDED", &deployment))
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment})
 	step()
 
 	// The deployment is recreated if deleted
-	deployments.Write(marshal(t, "DELETED", &deployment))
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment, IsDelete: true})
 	step()
-	<-deploymentOK
-	deployments.Write(marshal(t, "ADDED", &deployment))
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment})
 	step()
 
 	// check that nothing happens
-	deployments.Write(marshal(t, "ADDED", &deployment))
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment})
 
 	step()
 
 	deployment.OwnerReferences[0].UID = "wrong"
 
-	deployments.Write(marshal(t, "ADDED", &deployment))
+	client.PushDeployment(kubeapi.WatchEvent{Item: deployment})
 
 	step()
 
-	n, err = r.Read(buf[:])
-	if err != nil {
-		t.Fatal("ReadError", err)
-	}
-	data = buf[:n]
-	if !strings.HasSuffix(string(data), "Deployment xyz:bar is not owned by us.\n") {
+	data = logBuf.TakeString()
+	if !strings.HasSuffix(data, "Deployment xyz:bar is not owned by us.\n") {
 		t.Errorf("wrong warning: %s", data)
 	}
 
-	foos.Write(marshal(t, "DELETED", &foo))
+	client.PushFoo(kubeapi.WatchEvent{Item: foo, IsDelete: true})
 	step()
 
 	controller.RequestStop()
@@ -416,3 +416,40 @@ func TestFoo(t *testing.T) {
 		t.Errorf("unxpected error %s", err)
 	}
 }
+
+func TestStreamFooLogs(t *testing.T) {
+	controller, client := startTestController(t)
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-abc", Labels: map[string]string{"controller": "foo"}},
+	}
+	client.SetPods("default", []corev1.Pod{pod})
+
+	r, w := io.Pipe()
+	client.PodLogsFunc = func(namespace, podName string, opts kubeapi.LogOptions) (io.ReadCloser, error) {
+		if podName != "foo-abc" {
+			t.Errorf("wrong pod name: %s", podName)
+		}
+		return r, nil
+	}
+
+	lines, stop, err := controller.StreamFooLogs("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go io.WriteString(w, "hello\nworld\n")
+
+	if line := <-lines; line.Pod != "foo-abc" || line.Message != "hello" {
+		t.Errorf("wrong line: %+v", line)
+	}
+	if line := <-lines; line.Pod != "foo-abc" || line.Message != "world" {
+		t.Errorf("wrong line: %+v", line)
+	}
+
+	close(stop)
+	for range lines {
+	}
+
+	stopController(t, controller)
+}
@@ -1,36 +1,111 @@
 package kubeapi
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const apiPath = "/apis"
 
-// KubeClient represents a client to a kubernetes API server.
-type KubeClient struct {
-	client http.Client
-	url    url.URL
+// KubeClient is everything the controller needs from a client to the
+// Kubernetes API server. It is split out from HTTPClient, the real
+// implementation, so tests can substitute pkg/kubeapi/fake instead of
+// talking over HTTP.
+type KubeClient interface {
+	AddCustomResourceDefinition(ctx context.Context, crd *apiextensionsv1.CustomResourceDefinition) error
+	GetCustomResourceDefinitions(ctx context.Context, name string) (<-chan WatchEvent, chan<- struct{})
+	GetResources(ctx context.Context, group, version, namespace, path string, opts ListOptions,
+		v interface{}) (<-chan WatchEvent, chan<- struct{})
+	GetDeployments(ctx context.Context, namespace string, opts ListOptions) (<-chan WatchEvent, chan<- struct{})
+	AddDeployment(ctx context.Context, deployment *appsv1.Deployment) error
+	UpdateDeployment(ctx context.Context, deployment *appsv1.Deployment) error
+	UpdateDeploymentStatus(ctx context.Context, deployment *appsv1.Deployment) error
+	PatchStatus(ctx context.Context, group, version, namespace, path string, obj interface{}) error
+	Patch(ctx context.Context, group, version, namespace, path string, patchType PatchType,
+		fieldManager string, force bool, data []byte) error
+	ListPods(ctx context.Context, namespace, labelSelector string) ([]corev1.Pod, error)
+	GetPodLogs(ctx context.Context, namespace, podName string, opts LogOptions) (io.ReadCloser, error)
+	StreamPodLogs(ctx context.Context, namespace, podName string, opts LogOptions) (<-chan LogLine, chan<- struct{})
+	List(ctx context.Context, res Resource, opts ListOptions, predicate func(interface{}) bool) ([]interface{}, error)
+	Watch(ctx context.Context, res Resource, predicate func(interface{}) bool) (<-chan WatchEvent, chan<- struct{})
 }
 
-// NewClient returns a new KubeClient. The host is a string encoding
+// HTTPClient is the KubeClient implementation that talks to a real
+// Kubernetes API server over HTTP.
+type HTTPClient struct {
+	client    http.Client
+	url       url.URL
+	watchOpts WatchOptions
+}
+
+// NewClient returns a new HTTPClient. The host is a string encoding
 // the url of the api server (https://192.168.39.239:8443 for
 // expample).
-func NewClient(host string, transport http.RoundTripper) (*KubeClient, error) {
+func NewClient(host string, transport http.RoundTripper) (*HTTPClient, error) {
 	u, err := url.Parse(host + apiPath + "/")
 	if err != nil {
 		return nil, err
 	}
-	return &KubeClient{client: http.Client{Transport: transport}, url: *u}, nil
+	return &HTTPClient{client: http.Client{Transport: transport}, url: *u, watchOpts: DefaultWatchOptions()}, nil
+}
+
+// WatchOptions controls how GetResources, GetDeployments and
+// GetCustomResourceDefinitions behave across the lifetime of a watch:
+// whether they seed the caller with the current state before watching,
+// and how aggressively they reconnect once a watch connection ends. See
+// SetWatchOptions.
+type WatchOptions struct {
+	// InitialSync has produceResources LIST the resource before
+	// watching and emit a synthetic ADDED WatchEvent per item found,
+	// so the caller sees the current state without a separate List
+	// call. Reconnects after a 410 Gone always resync this way,
+	// regardless of InitialSync.
+	InitialSync bool
+	// ResyncPeriod, if non-zero, has produceResources drop and
+	// re-establish each watch connection at least this often, as a
+	// safety net against connections that go quiet without the server
+	// ever reporting an error.
+	ResyncPeriod time.Duration
+	// MinBackoff and MaxBackoff bound the jittered exponential backoff
+	// applied between reconnect attempts after a watch connection is
+	// lost (but not after a 410 Gone, which resyncs immediately).
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultWatchOptions returns the WatchOptions a new HTTPClient starts
+// with: an initial sync, no forced periodic resync, and backoff from
+// 100ms up to 30s.
+func DefaultWatchOptions() WatchOptions {
+	return WatchOptions{
+		InitialSync: true,
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+// SetWatchOptions replaces the WatchOptions client uses for every watch
+// started after this call. It is not safe to call while a watch started
+// by this client is in flight.
+func (client *HTTPClient) SetWatchOptions(opts WatchOptions) {
+	client.watchOpts = opts
 }
 
 // RequestError represents an http reply with an unsuccessful status code.
@@ -43,19 +118,36 @@ func (r *RequestError) Error() string {
 	return fmt.Sprintf("http request failed: code=%d body=\"%s\"", r.StatusCode, r.Body)
 }
 
-func (client *KubeClient) do(method, group, version, namespace, path string, query url.Values,
-	data []byte) (*http.Response, error) {
-	url := client.url
-	url.Path += group + "/"
-	url.Path += version + "/"
+// apiURL returns the URL for group/version/namespace/path, handling
+// both grouped APIs (/apis/{group}/{version}/...) and the core v1 API
+// (/api/{version}/...), which has no group segment, the same way
+// resourceURL does for the generic Resource type.
+func (client *HTTPClient) apiURL(group, version, namespace, path string) url.URL {
+	var u url.URL
+	if group == "" {
+		u = client.coreURL("")
+		u.Path = strings.TrimSuffix(u.Path, "v1/") + version + "/"
+	} else {
+		u = client.url
+		u.Path += group + "/" + version + "/"
+	}
 	if namespace != "" {
-		url.Path += "namespaces/" + namespace + "/"
+		u.Path += "namespaces/" + namespace + "/"
 	}
-	url.Path += path
+	u.Path += path
+	return u
+}
+
+func (client *HTTPClient) do(ctx context.Context, method, group, version, namespace, path string,
+	query url.Values, contentType string, data []byte) (*http.Response, error) {
+	url := client.apiURL(group, version, namespace, path)
 	url.RawQuery = query.Encode()
 	reader := ioutil.NopCloser(bytes.NewReader(data))
-	req := http.Request{Method: method, URL: &url, Body: reader}
-	resp, err := client.client.Do(&req)
+	req := (&http.Request{Method: method, URL: &url, Body: reader}).WithContext(ctx)
+	if contentType != "" {
+		req.Header = http.Header{"Content-Type": []string{contentType}}
+	}
+	resp, err := client.client.Do(req)
 	if err == nil && !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
 		defer resp.Body.Close()
 		// Ignore any errors from ReadAll, they are probably not as interesting as the
@@ -71,23 +163,23 @@ func (client *KubeClient) do(method, group, version, namespace, path string, que
 // this is accessing a non namespaced resource (not the default
 // namespace). An unsuccessful response is converted to an error, so
 // this just returns a io.ReadCloser for the body.
-func (client *KubeClient) Get(group, version, namespace, path string,
+func (client *HTTPClient) Get(ctx context.Context, group, version, namespace, path string,
 	query url.Values) (io.ReadCloser, error) {
-	resp, err := client.do("GET", group, version, namespace, path, query, nil)
+	resp, err := client.do(ctx, "GET", group, version, namespace, path, query, "", nil)
 	if err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
-func (client *KubeClient) putOrPost(method, group, version, namespace, path string,
-	obj interface{}) error {
+func (client *HTTPClient) putOrPost(ctx context.Context, method, group, version, namespace,
+	path string, obj interface{}) error {
 	data, err := json.Marshal(obj)
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.do(method, group, version, namespace, path, nil, data)
+	resp, err := client.do(ctx, method, group, version, namespace, path, nil, "", data)
 	if err == nil {
 		err = resp.Body.Close()
 	}
@@ -96,24 +188,133 @@ func (client *KubeClient) putOrPost(method, group, version, namespace, path stri
 
 // Post does a POST request on a resource. The body is the json
 // marshaling of obj. See Get for other parameters.
-func (client *KubeClient) Post(group, version, namespace, path string, obj interface{}) error {
-	return client.putOrPost("POST", group, version, namespace, path, obj)
+func (client *HTTPClient) Post(ctx context.Context, group, version, namespace, path string,
+	obj interface{}) error {
+	return client.putOrPost(ctx, "POST", group, version, namespace, path, obj)
 }
 
 // Put does a PUT request on a resource. See Post for the parameters.
-func (client *KubeClient) Put(group, version, namespace, path string, obj interface{}) error {
-	return client.putOrPost("PUT", group, version, namespace, path, obj)
+func (client *HTTPClient) Put(ctx context.Context, group, version, namespace, path string,
+	obj interface{}) error {
+	return client.putOrPost(ctx, "PUT", group, version, namespace, path, obj)
+}
+
+// PatchStatus merge-patches the status subresource of a resource, so
+// that callers that only reconcile status (rather than the whole
+// object) don't need to read-modify-write it, and don't need to set
+// ObjectMeta the way a PUT would require. See Post for the other
+// parameters.
+func (client *HTTPClient) PatchStatus(ctx context.Context, group, version, namespace, path string,
+	obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return client.Patch(ctx, group, version, namespace, path+"/status", MergePatch, "", false, data)
 }
 
 // Delete does a DELETE request on a resource. See Post for the parameters.
-func (client *KubeClient) Delete(group, version, namespace, path string) error {
-	resp, err := client.do("DELETE", group, version, namespace, path, nil, nil)
+func (client *HTTPClient) Delete(ctx context.Context, group, version, namespace, path string) error {
+	resp, err := client.do(ctx, "DELETE", group, version, namespace, path, nil, "", nil)
 	if err == nil {
 		resp.Body.Close()
 	}
 	return err
 }
 
+// PatchType selects the patch strategy Patch uses, matching one of the
+// Content-Type values the Kubernetes API server recognizes for a PATCH
+// request.
+type PatchType string
+
+const (
+	// StrategicMergePatch understands a resource's schema well enough
+	// to merge lists by key instead of replacing them wholesale. Only
+	// built-in types support it; use MergePatch for CRDs.
+	StrategicMergePatch PatchType = "application/strategic-merge-patch+json"
+	// MergePatch is RFC 7386: a plain JSON merge patch, supported by
+	// every resource including CRDs.
+	MergePatch PatchType = "application/merge-patch+json"
+	// JSONPatch is RFC 6902: a list of add/remove/replace operations.
+	JSONPatch PatchType = "application/json-patch+json"
+	// ApplyPatch requests server-side apply. It requires fieldManager,
+	// and ignores force unless another manager already owns a
+	// conflicting field.
+	ApplyPatch PatchType = "application/apply-patch+yaml"
+)
+
+// Patch applies data to a resource using patchType, the body being
+// whatever that strategy expects (a partial object for
+// StrategicMergePatch/MergePatch/ApplyPatch, a list of operations for
+// JSONPatch). fieldManager and force are only meaningful, and
+// fieldManager is required, for ApplyPatch. See Post for the other
+// parameters.
+func (client *HTTPClient) Patch(ctx context.Context, group, version, namespace, path string,
+	patchType PatchType, fieldManager string, force bool, data []byte) error {
+	query := url.Values{}
+	if patchType == ApplyPatch {
+		query.Set("fieldManager", fieldManager)
+		if force {
+			query.Set("force", "true")
+		}
+	}
+
+	resp, err := client.do(ctx, "PATCH", group, version, namespace, path, query, string(patchType), data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// UpdateDeploymentStatus merge-patches just a Deployment's status
+// subresource, so that a controller reconciling status doesn't risk
+// clobbering a concurrent update to its spec the way a full PUT via
+// UpdateDeployment would.
+func (client *HTTPClient) UpdateDeploymentStatus(ctx context.Context, deployment *appsv1.Deployment) error {
+	data, err := json.Marshal(struct {
+		Status appsv1.DeploymentStatus `json:"status"`
+	}{deployment.Status})
+	if err != nil {
+		return err
+	}
+	return client.Patch(ctx, "apps", "v1", deployment.Namespace, "deployments/"+deployment.Name+"/status",
+		MergePatch, "", false, data)
+}
+
+// ListOptions narrows and paginates a List, GetResources or
+// GetDeployments call. LabelSelector is usually built with Selector;
+// FieldSelector is a plain string since the field selector grammar is
+// much smaller (just equality/inequality of a handful of server known
+// fields).
+type ListOptions struct {
+	LabelSelector string
+	FieldSelector string
+	// Limit, if non-zero, caps how many items a single page of a List
+	// response holds; List and the initial sync of a watch follow the
+	// response's metadata.continue token to fetch the rest.
+	Limit int64
+	// Continue resumes a paginated List from a previous page's
+	// metadata.continue token.
+	Continue string
+}
+
+func (o ListOptions) toQuery() url.Values {
+	q := url.Values{}
+	if o.LabelSelector != "" {
+		q.Set("labelSelector", o.LabelSelector)
+	}
+	if o.FieldSelector != "" {
+		q.Set("fieldSelector", o.FieldSelector)
+	}
+	if o.Limit != 0 {
+		q.Set("limit", strconv.FormatInt(o.Limit, 10))
+	}
+	if o.Continue != "" {
+		q.Set("continue", o.Continue)
+	}
+	return q
+}
+
 // Returns true if the event is DELETED
 func parseEventType(ty string) (bool, error) {
 	// We get a full copy with MODIFIED, so we can treat it as ADDED
@@ -137,77 +338,317 @@ type WatchEvent struct {
 	Err      error
 }
 
-func (client *KubeClient) produceResources(group, version, namespace, path string,
-	query url.Values, v interface{}, out chan<- WatchEvent, stopCh <-chan struct{}) {
-	defer close(out)
+// watchErrKind classifies why a single watchResources connection ended,
+// so produceResources knows whether to give up, retry the same
+// connection after a backoff, or resync (LIST again) before
+// reconnecting.
+type watchErrKind int
+
+const (
+	// watchEnded means the caller asked us to stop (stopCh/ctx done);
+	// produceResources should close out and return.
+	watchEnded watchErrKind = iota
+	// watchLost means the connection failed (EOF, decode error,
+	// non-410 transport error); produceResources retries with
+	// backoff, reusing the last known resourceVersion.
+	watchLost
+	// watchExpired means the watch can't continue from its
+	// resourceVersion (a 410 Gone, or a forced periodic resync);
+	// produceResources must resync before reconnecting.
+	watchExpired
+)
+
+// objectMetaOf extracts the ObjectMeta embedded in item via reflection,
+// so watchResources can read its ResourceVersion without a type switch
+// over every resource produceResources is used for.
+func objectMetaOf(item interface{}) (metav1.ObjectMeta, bool) {
+	f := reflect.ValueOf(item).FieldByName("ObjectMeta")
+	if !f.IsValid() {
+		return metav1.ObjectMeta{}, false
+	}
+	om, ok := f.Interface().(metav1.ObjectMeta)
+	return om, ok
+}
+
+// jitter returns a duration somewhere in [d/2, d], so that many clients
+// reconnecting around the same time don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// cloneQuery returns a shallow copy of query, so callers that add their
+// own keys (watch, resourceVersion, ...) don't mutate the caller's
+// url.Values across reconnect attempts.
+func cloneQuery(query url.Values) url.Values {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	return q
+}
+
+// waitBackoff sleeps for d, returning false early if stopCh or ctx ends
+// first.
+func waitBackoff(stopCh <-chan struct{}, ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// resyncResources LISTs group/version/namespace/path, following
+// metadata.continue across multiple pages if the server returns one,
+// optionally emitting a synthetic ADDED WatchEvent for each item found
+// via send, so a caller sees the same events whether an object already
+// existed or just arrived. It returns the resourceVersion of the
+// (possibly multi-page) list to watch from; ok is false if a page's
+// LIST failed, in which case the error has already been sent.
+func (client *HTTPClient) resyncResources(ctx context.Context, group, version, namespace, path string,
+	query url.Values, v interface{}, emit bool, send func(WatchEvent) bool) (rv string, ok bool) {
 	ty := reflect.TypeOf(v)
-	if query == nil {
-		query = url.Values{}
+
+	q := cloneQuery(query)
+	for {
+		body, err := client.Get(ctx, group, version, namespace, path, q)
+		if err != nil {
+			send(WatchEvent{Err: fmt.Errorf("Watch failed: %w", err)})
+			return "", false
+		}
+
+		var list resourceList
+		err = json.NewDecoder(body).Decode(&list)
+		body.Close()
+		if err != nil {
+			send(WatchEvent{Err: fmt.Errorf("Could not decode list of %s: %w", path, err)})
+			return "", false
+		}
+
+		if list.Metadata.ResourceVersion != "" {
+			rv = list.Metadata.ResourceVersion
+		}
+
+		if emit {
+			for _, raw := range list.Items {
+				obj := reflect.New(ty)
+				if err := json.Unmarshal(raw, obj.Interface()); err != nil {
+					send(WatchEvent{Err: fmt.Errorf("Unmarshaling of resource failed: %w", err)})
+					return "", false
+				}
+				if !send(WatchEvent{Item: reflect.Indirect(obj).Interface()}) {
+					return "", false
+				}
+			}
+		}
+
+		if list.Metadata.Continue == "" {
+			return rv, true
+		}
+		q = cloneQuery(query)
+		q.Set("continue", list.Metadata.Continue)
+	}
+}
+
+// watchResources opens a single watch connection starting from rv (or
+// from now, if rv is empty) and forwards events to send until the
+// connection ends. resyncAfter, if non-zero, forces the connection
+// closed (returning watchExpired rather than watchLost) after that long,
+// implementing WatchOptions.ResyncPeriod. The returned resourceVersion
+// reflects every ADDED/MODIFIED/DELETED/BOOKMARK event observed, even
+// ones send didn't forward.
+func (client *HTTPClient) watchResources(ctx context.Context, group, version, namespace, path string,
+	query url.Values, v interface{}, rv string, resyncAfter time.Duration,
+	send func(WatchEvent) bool) (newRV string, kind watchErrKind) {
+	ty := reflect.TypeOf(v)
+
+	q := cloneQuery(query)
+	q["watch"] = []string{"true"}
+	q["allowWatchBookmarks"] = []string{"true"}
+	if rv != "" {
+		q["resourceVersion"] = []string{rv}
 	}
-	query["watch"] = []string{"true"}
 
-	bodyReader, err := client.Get(group, version, namespace, path, query)
+	resp, err := client.do(ctx, "GET", group, version, namespace, path, q, "", nil)
 	if err != nil {
-		out <- WatchEvent{Err: fmt.Errorf("Watch failed: %w", err)}
-		return
+		if re, ok := err.(*RequestError); ok && re.StatusCode == http.StatusGone {
+			return rv, watchExpired
+		}
+		if !send(WatchEvent{Err: fmt.Errorf("Watch failed: %w", err)}) {
+			return rv, watchEnded
+		}
+		return rv, watchLost
 	}
+	bodyReader := resp.Body
 
+	// closeBody is shared between this goroutine's defer and the one
+	// below, since both can race to close bodyReader (e.g. ctx being
+	// done at the same time the decode loop below hits an unrelated
+	// error); sync.Once keeps that from being a concurrent double
+	// Close on the same reader.
+	var closeOnce sync.Once
+	closeBody := func() { closeOnce.Do(func() { bodyReader.Close() }) }
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	forcedResync := make(chan struct{})
 	go func() {
-		_ = <-stopCh
+		var resyncTimer <-chan time.Time
+		if resyncAfter > 0 {
+			timer := time.NewTimer(resyncAfter)
+			defer timer.Stop()
+			resyncTimer = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-resyncTimer:
+			close(forcedResync)
+		case <-stopped:
+			return
+		}
 		// Closing bodyReader is probably the only way to stop
 		// decoder.Decode bellow.
-		err := bodyReader.Close()
-		// The call to Close should not fail. If it does,
-		// there is nothing for us to do but panic. We cannot
-		// send the error to the out channel as it might be
-		// closed. It should also not be ignored, as the loop
-		// bellow might be forever stuck in Decode.
+		closeBody()
+	}()
+	defer closeBody()
+
+	decoder := json.NewDecoder(bodyReader)
+	for {
+		we := metav1.WatchEvent{}
+		if err := decoder.Decode(&we); err != nil {
+			select {
+			case <-forcedResync:
+				return rv, watchExpired
+			default:
+			}
+			if !send(WatchEvent{Err: fmt.Errorf("Could not decode WatchEvent(%s): %w", path, err)}) {
+				return rv, watchEnded
+			}
+			return rv, watchLost
+		}
+
+		if we.Type == "BOOKMARK" {
+			obj := reflect.New(ty)
+			if err := json.Unmarshal(we.Object.Raw, obj.Interface()); err == nil {
+				if om, ok := objectMetaOf(reflect.Indirect(obj).Interface()); ok && om.ResourceVersion != "" {
+					rv = om.ResourceVersion
+				}
+			}
+			continue
+		}
+
+		isDelete, err := parseEventType(we.Type)
 		if err != nil {
-			panic(err)
+			if !send(WatchEvent{Err: err}) {
+				return rv, watchEnded
+			}
+			return rv, watchLost
+		}
+
+		obj := reflect.New(ty)
+		if err := json.Unmarshal(we.Object.Raw, obj.Interface()); err != nil {
+			if !send(WatchEvent{Err: fmt.Errorf("Unmarshaling of resource failed: %w", err)}) {
+				return rv, watchEnded
+			}
+			return rv, watchLost
 		}
-	}()
 
-	send := func(ev WatchEvent) {
+		item := reflect.Indirect(obj).Interface()
+		if om, ok := objectMetaOf(item); ok && om.ResourceVersion != "" {
+			rv = om.ResourceVersion
+		}
+		if !send(WatchEvent{IsDelete: isDelete, Item: item}) {
+			return rv, watchEnded
+		}
+	}
+}
+
+// produceResources seeds out with the current state of
+// group/version/namespace/path (if client's WatchOptions.InitialSync is
+// set) and then keeps it up to date with a watch, resuming from the
+// last seen resourceVersion and reconnecting (resyncing first if the
+// resourceVersion has expired) until stopCh is closed or ctx is done.
+// Each lost connection is also sent to out as a WatchEvent with Err
+// set before reconnecting. If the initial LIST fails, its error is
+// sent and produceResources returns without watching.
+func (client *HTTPClient) produceResources(ctx context.Context, group, version, namespace,
+	path string, query url.Values, v interface{}, out chan<- WatchEvent, stopCh <-chan struct{}) {
+	defer close(out)
+
+	send := func(ev WatchEvent) bool {
 		// If we were asked to stop, don't send. The event
 		// might be the last error produced by closing
 		// bodyReader.
 		select {
-		case _ = <-stopCh:
-			return
+		case <-stopCh:
+			return false
+		case <-ctx.Done():
+			return false
 		default:
 		}
 
-		// Send, but still watch stopCh in case the client is
-		// not interested.
+		// Send, but still watch stopCh and ctx in case the
+		// client is not interested.
 		select {
-		case _ = <-stopCh:
-			return
+		case <-stopCh:
+			return false
+		case <-ctx.Done():
+			return false
 		case out <- ev:
+			return true
 		}
 	}
 
-	decoder := json.NewDecoder(bodyReader)
+	opts := client.watchOpts
+	rv, ok := client.resyncResources(ctx, group, version, namespace, path, query, v, opts.InitialSync, send)
+	if !ok {
+		return
+	}
+
+	backoff := opts.MinBackoff
+	needsResync := false
 	for {
-		we := metav1.WatchEvent{}
-		if err = decoder.Decode(&we); err != nil {
-			err = fmt.Errorf("Could not decode WatchEvent(%s): %w", path, err)
-			send(WatchEvent{Err: err})
+		select {
+		case <-stopCh:
 			return
-		}
-		isDelete, err := parseEventType(we.Type)
-		if err != nil {
-			send(WatchEvent{Err: err})
+		case <-ctx.Done():
 			return
+		default:
 		}
 
-		obj := reflect.New(ty)
-		err = json.Unmarshal(we.Object.Raw, obj.Interface())
-		if err != nil {
-			err = fmt.Errorf("Unmarshaling of resource failed: %w", err)
-			send(WatchEvent{Err: err})
+		if needsResync {
+			rv, ok = client.resyncResources(ctx, group, version, namespace, path, query, v, true, send)
+			if ok {
+				needsResync = false
+				backoff = opts.MinBackoff
+				continue
+			}
+		} else {
+			var kind watchErrKind
+			rv, kind = client.watchResources(ctx, group, version, namespace, path, query, v, rv,
+				opts.ResyncPeriod, send)
+			switch kind {
+			case watchEnded:
+				return
+			case watchExpired:
+				needsResync = true
+				continue
+			}
+		}
+
+		if !waitBackoff(stopCh, ctx, jitter(backoff)) {
 			return
 		}
-		send(WatchEvent{IsDelete: isDelete, Item: reflect.Indirect(obj).Interface()})
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
 	}
 }
 
@@ -216,45 +657,235 @@ func (client *KubeClient) produceResources(group, version, namespace, path strin
 // returns a second channel that should be closed to request
 // GetResources to stop. The type of the resource is identified by
 // v. The produced WatchEvents will have Items of the same type as v.
-func (client *KubeClient) GetResources(group, version, namespace, path string, query url.Values,
-	v interface{}) (<-chan WatchEvent, chan<- struct{}) {
+func (client *HTTPClient) GetResources(ctx context.Context, group, version, namespace, path string,
+	opts ListOptions, v interface{}) (<-chan WatchEvent, chan<- struct{}) {
 	ch := make(chan WatchEvent)
 	stop := make(chan struct{})
-	go client.produceResources(group, version, namespace, path, query, v, ch, stop)
+	go client.produceResources(ctx, group, version, namespace, path, opts.toQuery(), v, ch, stop)
 	return ch, stop
 }
 
-// GetDeployments queries the api server for deployments. See GetResources for details.
-func (client *KubeClient) GetDeployments(namespace string) (<-chan WatchEvent, chan<- struct{}) {
-	return client.GetResources("apps", "v1", namespace, "deployments", nil,
+// GetDeployments queries the api server for deployments matching opts. See GetResources for details.
+func (client *HTTPClient) GetDeployments(ctx context.Context, namespace string, opts ListOptions) (
+	<-chan WatchEvent, chan<- struct{}) {
+	return client.GetResources(ctx, "apps", "v1", namespace, "deployments", opts,
 		appsv1.Deployment{})
 }
 
 // AddDeployment adds a new deployment.
-func (client *KubeClient) AddDeployment(deployment *appsv1.Deployment) error {
-	return client.Post("apps", "v1", deployment.Namespace, "deployments", deployment)
+func (client *HTTPClient) AddDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	return client.Post(ctx, "apps", "v1", deployment.Namespace, "deployments", deployment)
 }
 
 // UpdateDeployment replaces an existing deployment.
-func (client *KubeClient) UpdateDeployment(deployment *appsv1.Deployment) error {
-	return client.Put("apps", "v1", deployment.Namespace, "deployments/"+deployment.Name,
+func (client *HTTPClient) UpdateDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	return client.Put(ctx, "apps", "v1", deployment.Namespace, "deployments/"+deployment.Name,
 		deployment)
 }
 
 // DeleteDeployment deletes a deployment.
-func (client *KubeClient) DeleteDeployment(deployment *appsv1.Deployment) error {
-	return client.Delete("apps", "v1", deployment.Namespace, "deployments/"+deployment.Name)
+func (client *HTTPClient) DeleteDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	return client.Delete(ctx, "apps", "v1", deployment.Namespace, "deployments/"+deployment.Name)
 }
 
 // AddCustomResourceDefinition adds a new CRD.
-func (client *KubeClient) AddCustomResourceDefinition(crd *apiextensionsv1.CustomResourceDefinition) error {
-	return client.Post("apiextensions.k8s.io", "v1", "", "customresourcedefinitions", crd)
+func (client *HTTPClient) AddCustomResourceDefinition(ctx context.Context,
+	crd *apiextensionsv1.CustomResourceDefinition) error {
+	return client.Post(ctx, "apiextensions.k8s.io", "v1", "", "customresourcedefinitions", crd)
 }
 
 // GetCustomResourceDefinitions queries the api server for CRDs. See GetResources for details.
-func (client *KubeClient) GetCustomResourceDefinitions(name string) (<-chan WatchEvent,
-	chan<- struct{}) {
-	return client.GetResources("apiextensions.k8s.io", "v1", "", "customresourcedefinitions",
-		url.Values{"fieldSelector": []string{"metadata.name=" + name}},
+func (client *HTTPClient) GetCustomResourceDefinitions(ctx context.Context, name string) (
+	<-chan WatchEvent, chan<- struct{}) {
+	return client.GetResources(ctx, "apiextensions.k8s.io", "v1", "", "customresourcedefinitions",
+		ListOptions{FieldSelector: "metadata.name=" + name},
 		apiextensionsv1.CustomResourceDefinition{})
 }
+
+// coreURL returns the URL for path under the core v1 API, which is
+// rooted at /api/v1/ rather than /apis/{group}/{version}/ like the rest
+// of this client's endpoints. ListPods and GetPodLogs use it directly
+// since their path already embeds the namespace; apiURL handles the
+// same distinction for callers that pass group/namespace separately.
+func (client *HTTPClient) coreURL(path string) url.URL {
+	u := client.url
+	u.Path = strings.TrimSuffix(u.Path, "apis/") + "api/v1/" + path
+	return u
+}
+
+// ListPods returns the Pods in namespace matching labelSelector (the
+// Kubernetes selector grammar, e.g. "controller=foo"). An empty
+// labelSelector matches every Pod in the namespace.
+func (client *HTTPClient) ListPods(ctx context.Context, namespace, labelSelector string) (
+	[]corev1.Pod, error) {
+	u := client.coreURL("namespaces/" + namespace + "/pods")
+	if labelSelector != "" {
+		u.RawQuery = url.Values{"labelSelector": []string{labelSelector}}.Encode()
+	}
+
+	req := (&http.Request{Method: "GET", URL: &u}).WithContext(ctx)
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &RequestError{StatusCode: resp.StatusCode, Body: body}
+	}
+
+	var list corev1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("Could not decode PodList: %w", err)
+	}
+	return list.Items, nil
+}
+
+// LogOptions controls how GetPodLogs and StreamPodLogs read a Pod's log.
+type LogOptions struct {
+	// Follow keeps the response open and streams new lines as they are
+	// written, instead of returning the log as it is now.
+	Follow bool
+	// TailLines, if set, limits the response to the last N lines.
+	TailLines *int64
+	// SinceSeconds, if set, only returns lines newer than N seconds ago.
+	SinceSeconds *int64
+	// Container selects which container's log to read, for Pods with
+	// more than one. Required if the Pod has more than one container.
+	Container string
+	// Previous returns the log of the previous terminated container
+	// instance, for inspecting a container that just crashed.
+	Previous bool
+	// Timestamps has the API server prefix every line with its RFC3339
+	// timestamp. StreamPodLogs uses this prefix to fill in LogLine.Timestamp.
+	Timestamps bool
+}
+
+func (o LogOptions) toQuery() url.Values {
+	q := url.Values{}
+	if o.Follow {
+		q.Set("follow", "true")
+	}
+	if o.TailLines != nil {
+		q.Set("tailLines", strconv.FormatInt(*o.TailLines, 10))
+	}
+	if o.SinceSeconds != nil {
+		q.Set("sinceSeconds", strconv.FormatInt(*o.SinceSeconds, 10))
+	}
+	if o.Container != "" {
+		q.Set("container", o.Container)
+	}
+	if o.Previous {
+		q.Set("previous", "true")
+	}
+	if o.Timestamps {
+		q.Set("timestamps", "true")
+	}
+	return q
+}
+
+// GetPodLogs GETs a Pod's log. The caller must Close the returned
+// ReadCloser; with opts.Follow set, closing it is also how the caller
+// tells the API server to stop sending new lines.
+func (client *HTTPClient) GetPodLogs(ctx context.Context, namespace, podName string,
+	opts LogOptions) (io.ReadCloser, error) {
+	u := client.coreURL("namespaces/" + namespace + "/pods/" + podName + "/log")
+	u.RawQuery = opts.toQuery().Encode()
+
+	req := (&http.Request{Method: "GET", URL: &u}).WithContext(ctx)
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &RequestError{StatusCode: resp.StatusCode, Body: body}
+	}
+	return resp.Body, nil
+}
+
+// LogLine is a single line of a Pod's log, as produced by
+// StreamPodLogs. Timestamp is only set when the call's LogOptions had
+// Timestamps set.
+type LogLine struct {
+	Timestamp time.Time
+	Message   string
+}
+
+// StreamPodLogs follows a Pod's log and parses it into a channel of
+// LogLine, one per line. It returns a second channel that should be
+// closed to request StreamPodLogs to stop, mirroring GetResources:
+// closing stop aborts the underlying body read, rather than just
+// stopping the consumer loop.
+func (client *HTTPClient) StreamPodLogs(ctx context.Context, namespace, podName string,
+	opts LogOptions) (<-chan LogLine, chan<- struct{}) {
+	ch := make(chan LogLine)
+	stop := make(chan struct{})
+	go client.produceLogLines(ctx, namespace, podName, opts, ch, stop)
+	return ch, stop
+}
+
+func (client *HTTPClient) produceLogLines(ctx context.Context, namespace, podName string,
+	opts LogOptions, out chan<- LogLine, stopCh <-chan struct{}) {
+	defer close(out)
+
+	body, err := client.GetPodLogs(ctx, namespace, podName, opts)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-stopCh:
+		case <-ctx.Done():
+		}
+		// Closing body is probably the only way to stop
+		// scanner.Scan bellow.
+		body.Close()
+	}()
+	defer body.Close()
+
+	send := func(line LogLine) bool {
+		select {
+		case <-stopCh:
+			return false
+		case <-ctx.Done():
+			return false
+		default:
+		}
+
+		select {
+		case <-stopCh:
+			return false
+		case <-ctx.Done():
+			return false
+		case out <- line:
+			return true
+		}
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if !send(parseLogLine(scanner.Text(), opts.Timestamps)) {
+			return
+		}
+	}
+}
+
+// parseLogLine splits a raw log line into its timestamp, when present,
+// and the rest of the message.
+func parseLogLine(line string, hasTimestamp bool) LogLine {
+	if !hasTimestamp {
+		return LogLine{Message: line}
+	}
+	idx := strings.IndexByte(line, ' ')
+	if idx < 0 {
+		return LogLine{Message: line}
+	}
+	ts, err := time.Parse(time.RFC3339Nano, line[:idx])
+	if err != nil {
+		return LogLine{Message: line}
+	}
+	return LogLine{Timestamp: ts, Message: line[idx+1:]}
+}
@@ -0,0 +1,71 @@
+package kubeapi
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestJitterBounds(t *testing.T) {
+	if got := jitter(0); got != 0 {
+		t.Errorf("jitter(0) = %v, want 0", got)
+	}
+
+	d := 100 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		got := jitter(d)
+		if got < d/2 || got > d {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v]", d, got, d/2, d)
+		}
+	}
+}
+
+func TestCloneQueryIsIndependent(t *testing.T) {
+	orig := url.Values{"labelSelector": []string{"app=foo"}}
+	clone := cloneQuery(orig)
+	clone.Set("resourceVersion", "123")
+
+	if orig.Get("resourceVersion") != "" {
+		t.Errorf("cloneQuery did not isolate the caller's url.Values: %v", orig)
+	}
+	if clone.Get("labelSelector") != "app=foo" {
+		t.Errorf("cloneQuery dropped an existing key: %v", clone)
+	}
+}
+
+func TestWaitBackoffReturnsFalseOnStop(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+
+	start := time.Now()
+	if waitBackoff(stop, context.Background(), time.Minute) {
+		t.Error("waitBackoff returned true after stopCh was closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitBackoff took %v to notice stopCh was closed", elapsed)
+	}
+}
+
+func TestWaitBackoffReturnsFalseOnCtxDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if waitBackoff(make(chan struct{}), ctx, time.Minute) {
+		t.Error("waitBackoff returned true after ctx was done")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitBackoff took %v to notice ctx was done", elapsed)
+	}
+}
+
+func TestWaitBackoffWaitsOutD(t *testing.T) {
+	start := time.Now()
+	if !waitBackoff(make(chan struct{}), context.Background(), 10*time.Millisecond) {
+		t.Error("waitBackoff returned false with nothing asking it to stop")
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("waitBackoff returned after only %v, want at least 10ms", elapsed)
+	}
+}
@@ -0,0 +1,331 @@
+// Package fake provides an in-memory kubeapi.KubeClient for tests, so
+// they can drive the controller without going through httpmock and
+// hand-marshaled watch events.
+package fake
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sample-controller/pkg/kubeapi"
+)
+
+// Client is a kubeapi.KubeClient that stores objects in maps and
+// drives the foos/deployments watch channels directly, instead of
+// talking to an API server. AddDeployment/UpdateDeployment don't push
+// a corresponding watch event themselves: a real API server's watch
+// is a separate connection, so tests drive it explicitly with
+// PushDeployment, same as they would with a real watch stream.
+type Client struct {
+	mu sync.Mutex
+
+	crds map[string]apiextensionsv1.CustomResourceDefinition
+
+	deployments map[string]appsv1.Deployment
+	pods        map[string][]corev1.Pod
+
+	fooPushes       chan kubeapi.WatchEvent
+	depPushes       chan kubeapi.WatchEvent
+	foosCh          chan kubeapi.WatchEvent
+	deploymentsCh   chan kubeapi.WatchEvent
+	stopFoos        chan struct{}
+	stopDeployments chan struct{}
+
+	// AddDeploymentFunc and UpdateDeploymentFunc, when set, are called
+	// with the Deployment before it is stored, so tests can inspect
+	// what the controller creates and simulate API server errors by
+	// returning one.
+	AddDeploymentFunc    func(*appsv1.Deployment) error
+	UpdateDeploymentFunc func(*appsv1.Deployment) error
+
+	// PodLogsFunc, when set, is called instead of returning an empty
+	// stream, so tests can feed lines through GetPodLogs/StreamPodLogs.
+	PodLogsFunc func(namespace, podName string, opts kubeapi.LogOptions) (io.ReadCloser, error)
+}
+
+// New returns an empty Client.
+func New() *Client {
+	c := &Client{
+		crds:            make(map[string]apiextensionsv1.CustomResourceDefinition),
+		deployments:     make(map[string]appsv1.Deployment),
+		pods:            make(map[string][]corev1.Pod),
+		fooPushes:       make(chan kubeapi.WatchEvent),
+		depPushes:       make(chan kubeapi.WatchEvent),
+		foosCh:          make(chan kubeapi.WatchEvent),
+		deploymentsCh:   make(chan kubeapi.WatchEvent),
+		stopFoos:        make(chan struct{}),
+		stopDeployments: make(chan struct{}),
+	}
+	go relay(c.fooPushes, c.foosCh, c.stopFoos)
+	go relay(c.depPushes, c.deploymentsCh, c.stopDeployments)
+	return c
+}
+
+// relay forwards events pushed by a test from in to out, mirroring
+// produceResources: out is only closed once stop is closed, and a
+// pending send to out is abandoned if stop closes first, so
+// PushFoo/PushDeployment never block on the Controller having already
+// stopped watching.
+func relay(in <-chan kubeapi.WatchEvent, out chan<- kubeapi.WatchEvent, stop <-chan struct{}) {
+	defer close(out)
+	for {
+		select {
+		case ev := <-in:
+			select {
+			case out <- ev:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// PushFoo sends a WatchEvent on the channel returned by GetResources
+// for foos, as if it had come from the API server. It only blocks
+// until the event is handed to the relay goroutine, not until the
+// Controller has processed it.
+func (c *Client) PushFoo(ev kubeapi.WatchEvent) {
+	c.fooPushes <- ev
+}
+
+// PushDeployment sends a WatchEvent on the channel returned by
+// GetDeployments, as if it had come from the API server. See PushFoo.
+func (c *Client) PushDeployment(ev kubeapi.WatchEvent) {
+	c.depPushes <- ev
+}
+
+// AddCustomResourceDefinition records crd as already Established, so
+// the addCRD loop that waits for that condition returns immediately.
+func (c *Client) AddCustomResourceDefinition(ctx context.Context,
+	crd *apiextensionsv1.CustomResourceDefinition) error {
+	established := *crd
+	established.Status.Conditions = []apiextensionsv1.CustomResourceDefinitionCondition{
+		{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue},
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crds[crd.Name] = established
+	return nil
+}
+
+// GetCustomResourceDefinitions returns the CRD previously added with
+// that name, already Established, then closes the channel.
+func (c *Client) GetCustomResourceDefinitions(ctx context.Context, name string) (
+	<-chan kubeapi.WatchEvent, chan<- struct{}) {
+	ch := make(chan kubeapi.WatchEvent, 1)
+	stop := make(chan struct{})
+
+	c.mu.Lock()
+	crd, ok := c.crds[name]
+	c.mu.Unlock()
+
+	if ok {
+		ch <- kubeapi.WatchEvent{Item: crd}
+	}
+	close(ch)
+	return ch, stop
+}
+
+// GetResources returns the foos or deployments channel, fed by
+// PushFoo/PushDeployment. Other paths are not supported, since this
+// fake only exists to drive the controller's tests. opts is ignored:
+// tests control exactly what is pushed through PushFoo/PushDeployment,
+// so there is nothing for a selector to filter.
+func (c *Client) GetResources(ctx context.Context, group, version, namespace, path string,
+	opts kubeapi.ListOptions, v interface{}) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+	switch path {
+	case "foos":
+		return c.foosCh, c.stopFoos
+	case "deployments":
+		return c.deploymentsCh, c.stopDeployments
+	default:
+		panic("fake: unsupported resource path " + path)
+	}
+}
+
+// GetDeployments returns the deployments channel. See GetResources.
+func (c *Client) GetDeployments(ctx context.Context, namespace string, opts kubeapi.ListOptions) (
+	<-chan kubeapi.WatchEvent, chan<- struct{}) {
+	return c.GetResources(ctx, "apps", "v1", namespace, "deployments", opts, appsv1.Deployment{})
+}
+
+// AddDeployment calls AddDeploymentFunc, if set, then stores
+// deployment. It does not push a watch event; see PushDeployment.
+func (c *Client) AddDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	if c.AddDeploymentFunc != nil {
+		if err := c.AddDeploymentFunc(deployment); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deployments[deployment.Name] = *deployment
+	return nil
+}
+
+// UpdateDeployment calls UpdateDeploymentFunc, if set, then replaces
+// the stored deployment. See AddDeployment.
+func (c *Client) UpdateDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	if c.UpdateDeploymentFunc != nil {
+		if err := c.UpdateDeploymentFunc(deployment); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deployments[deployment.Name] = *deployment
+	return nil
+}
+
+// PatchStatus is a no-op: this fake does not model Foo status, since
+// none of its callers need to assert on it yet.
+func (c *Client) PatchStatus(ctx context.Context, group, version, namespace, path string,
+	obj interface{}) error {
+	return nil
+}
+
+// UpdateDeploymentStatus replaces the stored Deployment's status,
+// mirroring what a real merge patch of the status subresource would
+// do, without needing to decode a patch body.
+func (c *Client) UpdateDeploymentStatus(ctx context.Context, deployment *appsv1.Deployment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dep := c.deployments[deployment.Name]
+	dep.Status = deployment.Status
+	c.deployments[deployment.Name] = dep
+	return nil
+}
+
+// Patch is a no-op: this fake does not model generic patches, since no
+// caller needs to assert on one yet.
+func (c *Client) Patch(ctx context.Context, group, version, namespace, path string,
+	patchType kubeapi.PatchType, fieldManager string, force bool, data []byte) error {
+	return nil
+}
+
+// SetPods replaces the Pods ListPods returns for namespace, as if they
+// had just been observed from the API server.
+func (c *Client) SetPods(namespace string, pods []corev1.Pod) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pods[namespace] = pods
+}
+
+// ListPods returns the Pods previously set with SetPods that match
+// labelSelector.
+func (c *Client) ListPods(ctx context.Context, namespace, labelSelector string) ([]corev1.Pod, error) {
+	sel, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret []corev1.Pod
+	for _, pod := range c.pods[namespace] {
+		if sel.Matches(labels.Set(pod.Labels)) {
+			ret = append(ret, pod)
+		}
+	}
+	return ret, nil
+}
+
+// GetPodLogs calls PodLogsFunc, if set, otherwise returns an
+// already-empty stream.
+func (c *Client) GetPodLogs(ctx context.Context, namespace, podName string,
+	opts kubeapi.LogOptions) (io.ReadCloser, error) {
+	if c.PodLogsFunc != nil {
+		return c.PodLogsFunc(namespace, podName, opts)
+	}
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+// StreamPodLogs calls GetPodLogs, then reads it line by line into
+// kubeapi.LogLine values, honoring stop the same way the real client
+// does: closing it aborts the underlying read, not just the consumer
+// loop.
+func (c *Client) StreamPodLogs(ctx context.Context, namespace, podName string,
+	opts kubeapi.LogOptions) (<-chan kubeapi.LogLine, chan<- struct{}) {
+	ch := make(chan kubeapi.LogLine)
+	stop := make(chan struct{})
+
+	body, err := c.GetPodLogs(ctx, namespace, podName, opts)
+	if err != nil {
+		close(ch)
+		return ch, stop
+	}
+
+	go func() {
+		defer close(ch)
+		go func() {
+			<-stop
+			body.Close()
+		}()
+		defer body.Close()
+
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			select {
+			case ch <- kubeapi.LogLine{Message: scanner.Text()}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return ch, stop
+}
+
+// List returns the Deployments or Pods matching predicate. opts is
+// ignored: this fake's data sets are small enough in tests that
+// filtering/pagination isn't worth the bookkeeping. Other resources
+// aren't listable this way, since nothing currently needs them here.
+func (c *Client) List(ctx context.Context, res kubeapi.Resource, opts kubeapi.ListOptions,
+	predicate func(interface{}) bool) ([]interface{}, error) {
+	c.mu.Lock()
+	var all []interface{}
+	switch res.Plural {
+	case "deployments":
+		for _, d := range c.deployments {
+			all = append(all, d)
+		}
+	case "pods":
+		for _, pod := range c.pods[res.Namespace] {
+			all = append(all, pod)
+		}
+	default:
+		c.mu.Unlock()
+		return nil, fmt.Errorf("fake: unsupported resource %s", res.Plural)
+	}
+	c.mu.Unlock()
+
+	var ret []interface{}
+	for _, item := range all {
+		if predicate == nil || predicate(item) {
+			ret = append(ret, item)
+		}
+	}
+	return ret, nil
+}
+
+// Watch returns the foos or deployments channel for res.Plural; see
+// GetResources. predicate is not applied: the fake's event streams are
+// small enough in tests that filtering isn't worth the bookkeeping.
+func (c *Client) Watch(ctx context.Context, res kubeapi.Resource,
+	predicate func(interface{}) bool) (<-chan kubeapi.WatchEvent, chan<- struct{}) {
+	return c.GetResources(ctx, res.Group, res.Version, res.Namespace, res.Plural, kubeapi.ListOptions{}, res.Prototype)
+}
@@ -0,0 +1,156 @@
+package kubeapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	inClusterCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// tokenRefreshInterval bounds how stale the Authorization header
+	// can get after kubelet rotates the service account token on disk.
+	tokenRefreshInterval = time.Minute
+)
+
+// tokenRoundTripper injects the current service account token as a
+// Bearer Authorization header on every request, reloading it from
+// tokenFile periodically since kubelet rotates it.
+type tokenRoundTripper struct {
+	base      http.RoundTripper
+	tokenFile string
+
+	mu    sync.RWMutex
+	token string
+}
+
+func newTokenRoundTripper(base http.RoundTripper, tokenFile string, refresh time.Duration) (
+	*tokenRoundTripper, error) {
+	rt := &tokenRoundTripper{base: base, tokenFile: tokenFile}
+	if err := rt.reload(); err != nil {
+		return nil, err
+	}
+	go rt.refreshLoop(refresh)
+	return rt, nil
+}
+
+func (rt *tokenRoundTripper) reload() error {
+	data, err := ioutil.ReadFile(rt.tokenFile)
+	if err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	rt.token = strings.TrimSpace(string(data))
+	rt.mu.Unlock()
+	return nil
+}
+
+func (rt *tokenRoundTripper) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Best effort: if the file is momentarily missing during a
+		// rotation, keep using the last token we read.
+		rt.reload()
+	}
+}
+
+func (rt *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.RLock()
+	token := rt.token
+	rt.mu.RUnlock()
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return rt.base.RoundTrip(req)
+}
+
+// NewInClusterClient returns an HTTPClient configured the way the
+// standard in-cluster config is: the API server host/port comes from
+// KUBERNETES_SERVICE_HOST/KUBERNETES_SERVICE_PORT, the CA bundle and
+// bearer token come from the service account mounted at
+// /var/run/secrets/kubernetes.io/serviceaccount. The token is reloaded
+// from disk every tokenRefreshInterval, since kubelet rotates it.
+func NewInClusterClient() (*HTTPClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf(
+			"unable to load in-cluster configuration: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	caData, err := ioutil.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read in-cluster CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("could not parse in-cluster CA certificate from %s", inClusterCAFile)
+	}
+
+	base := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	transport, err := newTokenRoundTripper(base, inClusterTokenFile, tokenRefreshInterval)
+	if err != nil {
+		return nil, fmt.Errorf("could not read in-cluster token: %w", err)
+	}
+
+	return NewClient("https://"+net.JoinHostPort(host, port), transport)
+}
+
+// serviceAccountClaims is the subset of a service account token's JWT
+// claims InClusterNamespace needs.
+type serviceAccountClaims struct {
+	Namespace string `json:"kubernetes.io/serviceaccount/namespace"`
+}
+
+// InClusterNamespace returns the namespace of the running Pod. It first
+// tries the service account's namespace file, falling back to the
+// namespace claim of the token JWT when that file is missing.
+func InClusterNamespace() (string, error) {
+	data, err := ioutil.ReadFile(inClusterNamespaceFile)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	token, err := ioutil.ReadFile(inClusterTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read in-cluster namespace or token: %w", err)
+	}
+	return namespaceFromToken(strings.TrimSpace(string(token)))
+}
+
+func namespaceFromToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed service account token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("could not decode service account token: %w", err)
+	}
+
+	var claims serviceAccountClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("could not parse service account token claims: %w", err)
+	}
+	if claims.Namespace == "" {
+		return "", fmt.Errorf("service account token has no namespace claim")
+	}
+	return claims.Namespace, nil
+}
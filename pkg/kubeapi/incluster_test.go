@@ -0,0 +1,48 @@
+package kubeapi
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// fakeServiceAccountToken builds an unsigned JWT with payload as its
+// claims JSON, the same shape kubelet mounts into a Pod.
+func fakeServiceAccountToken(payload string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	body := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return header + "." + body + ".signature"
+}
+
+func TestNamespaceFromToken(t *testing.T) {
+	token := fakeServiceAccountToken(`{"kubernetes.io/serviceaccount/namespace":"kube-system"}`)
+	ns, err := namespaceFromToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "kube-system" {
+		t.Errorf("namespaceFromToken = %q, want %q", ns, "kube-system")
+	}
+}
+
+func TestNamespaceFromTokenMalformed(t *testing.T) {
+	if _, err := namespaceFromToken("not-a-jwt"); err == nil {
+		t.Error("expected an error for a token with less than 3 dot-separated parts")
+	}
+}
+
+func TestNamespaceFromTokenBadPayload(t *testing.T) {
+	token := "header." + "not-base64url!!!" + ".signature"
+	if _, err := namespaceFromToken(token); err == nil {
+		t.Error("expected an error for a payload that doesn't decode")
+	}
+}
+
+func TestNamespaceFromTokenMissingClaim(t *testing.T) {
+	token := fakeServiceAccountToken(`{}`)
+	if _, err := namespaceFromToken(token); err == nil {
+		t.Error("expected an error when the namespace claim is absent")
+	} else if !strings.Contains(err.Error(), "namespace claim") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package kubeapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		hasTimestamp bool
+		want         LogLine
+	}{
+		{
+			name:         "no timestamp requested",
+			line:         "2020-01-02T03:04:05.000000000Z hello world",
+			hasTimestamp: false,
+			want:         LogLine{Message: "2020-01-02T03:04:05.000000000Z hello world"},
+		},
+		{
+			name:         "timestamp present",
+			line:         "2020-01-02T03:04:05.000000000Z hello world",
+			hasTimestamp: true,
+			want: LogLine{
+				Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+				Message:   "hello world",
+			},
+		},
+		{
+			name:         "no space in line",
+			line:         "2020-01-02T03:04:05.000000000Z",
+			hasTimestamp: true,
+			want:         LogLine{Message: "2020-01-02T03:04:05.000000000Z"},
+		},
+		{
+			name:         "malformed timestamp falls back to the whole line",
+			line:         "not-a-timestamp hello world",
+			hasTimestamp: true,
+			want:         LogLine{Message: "not-a-timestamp hello world"},
+		},
+		{
+			name:         "empty line",
+			line:         "",
+			hasTimestamp: true,
+			want:         LogLine{Message: ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseLogLine(tt.line, tt.hasTimestamp)
+			if !got.Timestamp.Equal(tt.want.Timestamp) || got.Message != tt.want.Message {
+				t.Errorf("parseLogLine(%q, %v) = %+v, want %+v", tt.line, tt.hasTimestamp, got, tt.want)
+			}
+		})
+	}
+}
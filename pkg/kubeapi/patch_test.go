@@ -0,0 +1,117 @@
+package kubeapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// recordingResponder returns a responder that stashes the last request
+// it saw in *req, so a test can assert on its method, Content-Type and
+// query params after the call returns.
+func recordingResponder(req **http.Request) httpmock.Responder {
+	return func(r *http.Request) (*http.Response, error) {
+		*req = r
+		return httpmock.NewStringResponse(200, ""), nil
+	}
+}
+
+func TestPatchSetsContentTypeFromPatchType(t *testing.T) {
+	client, server := newTestClient(t)
+	var req *http.Request
+	server.RegisterResponder("PATCH", "/apis/apps/v1/deployments/foo", recordingResponder(&req))
+
+	if err := client.Patch(context.Background(), "apps", "v1", "", "deployments/foo",
+		MergePatch, "", false, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != string(MergePatch) {
+		t.Errorf("Content-Type = %q, want %q", ct, MergePatch)
+	}
+}
+
+func TestPatchSetsFieldManagerAndForceOnlyForApplyPatch(t *testing.T) {
+	client, server := newTestClient(t)
+	var req *http.Request
+	server.RegisterResponder("PATCH", "/apis/apps/v1/deployments/foo", recordingResponder(&req))
+
+	if err := client.Patch(context.Background(), "apps", "v1", "", "deployments/foo",
+		ApplyPatch, "my-controller", true, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	q := req.URL.Query()
+	if got := q.Get("fieldManager"); got != "my-controller" {
+		t.Errorf("fieldManager = %q, want %q", got, "my-controller")
+	}
+	if got := q.Get("force"); got != "true" {
+		t.Errorf("force = %q, want %q", got, "true")
+	}
+
+	if err := client.Patch(context.Background(), "apps", "v1", "", "deployments/foo",
+		MergePatch, "my-controller", true, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if q := req.URL.Query(); q.Get("fieldManager") != "" || q.Get("force") != "" {
+		t.Errorf("MergePatch should not set fieldManager/force, got %v", q)
+	}
+}
+
+func TestUpdateDeploymentStatusMergePatchesJustTheStatus(t *testing.T) {
+	client, server := newTestClient(t)
+	var req *http.Request
+	server.RegisterResponder("PATCH", "/apis/apps/v1/namespaces/ns/deployments/foo/status",
+		recordingResponder(&req))
+
+	dep := &appsv1.Deployment{}
+	dep.Namespace = "ns"
+	dep.Name = "foo"
+	dep.Status.AvailableReplicas = 3
+
+	if err := client.UpdateDeploymentStatus(context.Background(), dep); err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != string(MergePatch) {
+		t.Errorf("Content-Type = %q, want %q", ct, MergePatch)
+	}
+
+	var body struct {
+		Status appsv1.DeploymentStatus `json:"status"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status.AvailableReplicas != 3 {
+		t.Errorf("patched status = %+v, want AvailableReplicas=3", body.Status)
+	}
+}
+
+// TestPatchStatusSendsAPatchNotAPut guards against regressing to a PUT
+// whose body has no ObjectMeta: the API server would reject that with
+// "the name of the object does not match the name on the URL", since
+// nothing in the body sets metadata.name.
+func TestPatchStatusSendsAPatchNotAPut(t *testing.T) {
+	client, server := newTestClient(t)
+	var req *http.Request
+	server.RegisterResponder("PATCH", "/apis/example.com/v1/foos/bar/status", recordingResponder(&req))
+	server.RegisterNoResponder(httpmock.NewStringResponder(405, "PUT should not be used"))
+
+	patch := struct {
+		Status string `json:"status"`
+	}{"ready"}
+	if err := client.PatchStatus(context.Background(), "example.com", "v1", "", "foos/bar", &patch); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "PATCH" {
+		t.Errorf("method = %q, want PATCH", req.Method)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != string(MergePatch) {
+		t.Errorf("Content-Type = %q, want %q", ct, MergePatch)
+	}
+}
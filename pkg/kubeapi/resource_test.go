@@ -0,0 +1,83 @@
+package kubeapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newTestClient(t *testing.T) (*HTTPClient, *httpmock.MockTransport) {
+	t.Helper()
+	server := httpmock.NewMockTransport()
+	client, err := NewClient("", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+var podResource = Resource{Version: "v1", Plural: "pods", Prototype: corev1.Pod{}}
+
+func TestListDecodesItemsAndAppliesPredicate(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+		"metadata": map[string]interface{}{},
+		"items": []map[string]interface{}{
+			{"metadata": map[string]interface{}{"name": "a"}},
+			{"metadata": map[string]interface{}{"name": "b"}},
+		},
+	}))
+
+	got, err := client.List(context.Background(), podResource, ListOptions{},
+		func(item interface{}) bool { return item.(corev1.Pod).Name == "b" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].(corev1.Pod).Name != "b" {
+		t.Errorf("List = %+v, want a single Pod named %q", got, "b")
+	}
+}
+
+// TestWatchAppliesPredicate checks that Watch, which delegates to
+// produceResources for its resilience, still filters events with
+// predicate before forwarding them to the caller.
+func TestWatchAppliesPredicate(t *testing.T) {
+	client, server := newTestClient(t)
+	watchBody := strings.Join([]string{
+		`{"type":"ADDED","object":{"metadata":{"name":"skip"}}}`,
+		`{"type":"ADDED","object":{"metadata":{"name":"keep"}}}`,
+	}, "\n") + "\n"
+	server.RegisterResponder("GET", "/api/v1/pods", func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("watch") == "true" {
+			return httpmock.NewStringResponse(200, watchBody), nil
+		}
+		return httpmock.NewJsonResponse(200, map[string]interface{}{
+			"metadata": map[string]interface{}{},
+			"items":    []map[string]interface{}{},
+		})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, stop := client.Watch(ctx, podResource, func(item interface{}) bool {
+		return item.(corev1.Pod).Name == "keep"
+	})
+	defer close(stop)
+
+	select {
+	case ev := <-ch:
+		if ev.Err != nil {
+			t.Fatalf("unexpected error: %v", ev.Err)
+		}
+		if got := ev.Item.(corev1.Pod).Name; got != "keep" {
+			t.Errorf("got Pod %q, want %q", got, "keep")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not receive the matching Pod in time")
+	}
+}
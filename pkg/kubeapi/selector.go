@@ -0,0 +1,58 @@
+package kubeapi
+
+import "strings"
+
+// Selector builds a Kubernetes label selector one requirement at a
+// time, rendering to the grammar ListOptions.LabelSelector and the
+// Kubernetes API server expect (e.g. "app=foo,tier notin (canary,dev)"),
+// instead of callers hand-formatting it.
+type Selector struct {
+	terms []string
+}
+
+// NewSelector returns an empty Selector, matching everything.
+func NewSelector() *Selector {
+	return &Selector{}
+}
+
+// Eq requires label key to equal value.
+func (s *Selector) Eq(key, value string) *Selector {
+	s.terms = append(s.terms, key+"="+value)
+	return s
+}
+
+// NotEq requires label key to not equal value.
+func (s *Selector) NotEq(key, value string) *Selector {
+	s.terms = append(s.terms, key+"!="+value)
+	return s
+}
+
+// In requires label key's value to be one of values.
+func (s *Selector) In(key string, values ...string) *Selector {
+	s.terms = append(s.terms, key+" in ("+strings.Join(values, ",")+")")
+	return s
+}
+
+// NotIn requires label key's value to not be one of values.
+func (s *Selector) NotIn(key string, values ...string) *Selector {
+	s.terms = append(s.terms, key+" notin ("+strings.Join(values, ",")+")")
+	return s
+}
+
+// HasLabel requires key to be set, regardless of value.
+func (s *Selector) HasLabel(key string) *Selector {
+	s.terms = append(s.terms, key)
+	return s
+}
+
+// NotHasLabel requires key to not be set.
+func (s *Selector) NotHasLabel(key string) *Selector {
+	s.terms = append(s.terms, "!"+key)
+	return s
+}
+
+// String renders the Selector to Kubernetes' selector grammar, ready to
+// use as ListOptions.LabelSelector.
+func (s *Selector) String() string {
+	return strings.Join(s.terms, ",")
+}
@@ -0,0 +1,94 @@
+package kubeapi
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSelectorString(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  *Selector
+		want string
+	}{
+		{"empty", NewSelector(), ""},
+		{"eq", NewSelector().Eq("app", "foo"), "app=foo"},
+		{"noteq", NewSelector().NotEq("app", "foo"), "app!=foo"},
+		{"in", NewSelector().In("tier", "canary", "dev"), "tier in (canary,dev)"},
+		{"notin", NewSelector().NotIn("tier", "canary", "dev"), "tier notin (canary,dev)"},
+		{"haslabel", NewSelector().HasLabel("owned-by"), "owned-by"},
+		{"nothaslabel", NewSelector().NotHasLabel("owned-by"), "!owned-by"},
+		{
+			"combined",
+			NewSelector().Eq("app", "foo").NotIn("tier", "canary", "dev").HasLabel("owned-by"),
+			"app=foo,tier notin (canary,dev),owned-by",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sel.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListOptionsToQuery(t *testing.T) {
+	q := ListOptions{
+		LabelSelector: "app=foo",
+		FieldSelector: "metadata.name=bar",
+		Limit:         50,
+		Continue:      "tok",
+	}.toQuery()
+
+	want := map[string]string{
+		"labelSelector": "app=foo",
+		"fieldSelector": "metadata.name=bar",
+		"limit":         "50",
+		"continue":      "tok",
+	}
+	for k, v := range want {
+		if got := q.Get(k); got != v {
+			t.Errorf("toQuery()[%q] = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestListOptionsToQueryOmitsUnsetFields(t *testing.T) {
+	q := ListOptions{}.toQuery()
+	if len(q) != 0 {
+		t.Errorf("toQuery() = %v, want empty for a zero ListOptions", q)
+	}
+}
+
+// TestListFollowsContinueToken checks that List keeps paging as long as
+// the server returns metadata.continue, rather than stopping after the
+// first page, so a caller that sets ListOptions.Limit sees every item
+// across however many pages the server splits the response into.
+func TestListFollowsContinueToken(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("continue") == "" {
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"metadata": map[string]interface{}{"continue": "page2"},
+				"items":    []map[string]interface{}{{"metadata": map[string]interface{}{"name": "a"}}},
+			})
+		}
+		return httpmock.NewJsonResponse(200, map[string]interface{}{
+			"metadata": map[string]interface{}{},
+			"items":    []map[string]interface{}{{"metadata": map[string]interface{}{"name": "b"}}},
+		})
+	})
+
+	got, err := client.List(context.Background(), podResource, ListOptions{Limit: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].(corev1.Pod).Name != "a" || got[1].(corev1.Pod).Name != "b" {
+		t.Errorf("List = %+v, want pods named a then b", got)
+	}
+}
@@ -0,0 +1,154 @@
+package kubeapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func collectEvents(send func(WatchEvent) bool) (*[]WatchEvent, func(WatchEvent) bool) {
+	var got []WatchEvent
+	return &got, func(ev WatchEvent) bool {
+		got = append(got, ev)
+		return true
+	}
+}
+
+func TestResyncResourcesCapturesResourceVersion(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "42"},
+		"items":    []map[string]interface{}{{"metadata": map[string]interface{}{"name": "a"}}},
+	}))
+
+	got, send := collectEvents(nil)
+	rv, ok := client.resyncResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, true, send)
+	if !ok {
+		t.Fatal("resyncResources returned ok=false")
+	}
+	if rv != "42" {
+		t.Errorf("rv = %q, want %q", rv, "42")
+	}
+	if len(*got) != 1 || (*got)[0].Item.(corev1.Pod).Name != "a" {
+		t.Errorf("events = %+v, want a single ADDED Pod named a", *got)
+	}
+}
+
+func TestResyncResourcesDoesNotEmitWhenToldNotTo(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "1"},
+		"items":    []map[string]interface{}{{"metadata": map[string]interface{}{"name": "a"}}},
+	}))
+
+	got, send := collectEvents(nil)
+	if _, ok := client.resyncResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, false, send); !ok {
+		t.Fatal("resyncResources returned ok=false")
+	}
+	if len(*got) != 0 {
+		t.Errorf("events = %+v, want none since emit was false", *got)
+	}
+}
+
+func TestResyncResourcesReportsTransportFailure(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewStringResponder(500, "boom"))
+
+	got, send := collectEvents(nil)
+	if _, ok := client.resyncResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, true, send); ok {
+		t.Error("resyncResources returned ok=true for a failed LIST")
+	}
+	if len(*got) != 1 || (*got)[0].Err == nil {
+		t.Errorf("events = %+v, want a single error event", *got)
+	}
+}
+
+func TestWatchResourcesReturnsExpiredOn410(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewStringResponder(http.StatusGone, "gone"))
+
+	got, send := collectEvents(nil)
+	rv, kind := client.watchResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, "7", 0, send)
+	if kind != watchExpired {
+		t.Errorf("kind = %v, want watchExpired", kind)
+	}
+	if rv != "7" {
+		t.Errorf("rv = %q, want the resourceVersion unchanged at %q", rv, "7")
+	}
+	if len(*got) != 0 {
+		t.Errorf("events = %+v, want none: a 410 is not forwarded as an error", *got)
+	}
+}
+
+func TestWatchResourcesUpdatesResourceVersionAndSkipsBookmarks(t *testing.T) {
+	client, server := newTestClient(t)
+	body := strings.Join([]string{
+		`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"10"}}}`,
+		`{"type":"ADDED","object":{"metadata":{"name":"a","resourceVersion":"11"}}}`,
+		`{"type":"DELETED","object":{"metadata":{"name":"a","resourceVersion":"12"}}}`,
+	}, "\n") + "\n"
+	server.RegisterResponder("GET", "/api/v1/pods", httpmock.NewStringResponder(200, body))
+
+	got, send := collectEvents(nil)
+	rv, kind := client.watchResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, "", 0, send)
+	if kind != watchLost {
+		t.Errorf("kind = %v, want watchLost once the body is exhausted", kind)
+	}
+	if rv != "12" {
+		t.Errorf("rv = %q, want %q", rv, "12")
+	}
+	// The BOOKMARK isn't forwarded, so the first two events are the
+	// ADDED/DELETED pair; the third is the EOF once the body (and so
+	// the events) run out.
+	if len(*got) != 3 {
+		t.Fatalf("events = %+v, want 3: ADDED, DELETED, then the EOF", *got)
+	}
+	if (*got)[0].IsDelete || (*got)[1].IsDelete != true {
+		t.Errorf("events = %+v, want ADDED then DELETED", *got)
+	}
+	if (*got)[2].Err == nil {
+		t.Errorf("events[2] = %+v, want the EOF surfaced as an error", (*got)[2])
+	}
+}
+
+// TestWatchResourcesForcedResyncReportsExpiredNotLost checks that
+// WatchOptions.ResyncPeriod ends the connection as watchExpired (so
+// produceResources resyncs) rather than watchLost (which would just
+// retry the watch from the same resourceVersion) once resyncAfter
+// elapses, even though nothing ever goes wrong with the connection
+// itself.
+func TestWatchResourcesForcedResyncReportsExpiredNotLost(t *testing.T) {
+	client, server := newTestClient(t)
+	pr, _ := io.Pipe()
+	server.RegisterResponder("GET", "/api/v1/pods",
+		httpmock.ResponderFromResponse(&http.Response{StatusCode: 200, Body: pr}))
+
+	got, send := collectEvents(nil)
+	start := time.Now()
+	rv, kind := client.watchResources(context.Background(), "", "v1", "", "pods", url.Values{},
+		corev1.Pod{}, "5", 20*time.Millisecond, send)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("watchResources took %v to honor resyncAfter", elapsed)
+	}
+	if kind != watchExpired {
+		t.Errorf("kind = %v, want watchExpired for a forced resync", kind)
+	}
+	if rv != "5" {
+		t.Errorf("rv = %q, want the resourceVersion unchanged at %q", rv, "5")
+	}
+	if len(*got) != 0 {
+		t.Errorf("events = %+v, want none for a forced resync", *got)
+	}
+}
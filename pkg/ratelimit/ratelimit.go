@@ -1,71 +1,208 @@
 package ratelimit
 
-import "time"
+import (
+	"math/bits"
+	"time"
+)
 
-// RateLimiter is an interface that encapsulates limiting how often an
-// operation is performed.
-//
-// Users should call AskTick when they have an operation to perform
-// and then block reading from the channel returned by GetChan.
+// Clock abstracts access to the current time so tests can advance
+// time deterministically instead of waiting on real timers.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RateLimiter paces retries of keyed work items. It combines a token
+// bucket shared by every key (rate tokens per second, up to burst)
+// with a per-key exponential backoff, so a key that keeps failing is
+// retried less and less often without throttling unrelated keys.
 //
-// Implementations send a message on the channel when there has been
-// at least one request and the implementation specific rate limit is
-// satisfied.
+// Call AskTickFor when a key has work to (re)try. Get blocks until
+// some key is both past its backoff delay and a token is available,
+// then returns it. Forget resets a key's backoff, typically once it
+// has been processed successfully.
 //
-// Stop the RateLimiter to release resources.
+// Stop the RateLimiter to release resources. Once stopped, Get
+// returns ok=false.
 type RateLimiter interface {
-	AskTick()
-	GetChan() <-chan struct{}
+	AskTickFor(key string)
+	Forget(key string)
+	Get() (key string, ok bool)
 	Stop()
 }
 
+type keyState struct {
+	failures int
+	readyAt  time.Time
+}
+
 type rateLimiterImpl struct {
-	ask  chan struct{}
-	tick chan struct{}
-	stop chan struct{}
+	ask    chan string
+	forget chan string
+	get    chan string
+	stop   chan struct{}
 }
 
-func (rl *rateLimiterImpl) AskTick() {
-	rl.ask <- struct{}{}
+func (rl *rateLimiterImpl) AskTickFor(key string) {
+	rl.ask <- key
 }
 
-func (rl *rateLimiterImpl) GetChan() <-chan struct{} {
-	return rl.tick
+func (rl *rateLimiterImpl) Forget(key string) {
+	rl.forget <- key
+}
+
+func (rl *rateLimiterImpl) Get() (string, bool) {
+	key, ok := <-rl.get
+	return key, ok
 }
 
 func (rl *rateLimiterImpl) Stop() {
-	rl.stop <- struct{}{}
+	close(rl.stop)
+}
+
+// New returns a RateLimiter that allows up to rate keys per second,
+// with bursts of up to burst, and that backs a repeatedly failing key
+// off: the first AskTickFor for a key is not delayed, the next one
+// waits 2*baseDelay, and the delay doubles each time AskTickFor is
+// called for a key that isn't already pending, capped at maxDelay,
+// until Forget resets it. Calling
+// AskTickFor again for a key that is already pending (i.e. it hasn't
+// been delivered by Get yet) just coalesces into the existing
+// request, without advancing the backoff, so ordinary reconciliation
+// churn on a healthy key doesn't compound into the same backoff
+// meant for repeated failures.
+func New(rate float64, burst int, baseDelay, maxDelay time.Duration) RateLimiter {
+	return newWithClock(rate, burst, baseDelay, maxDelay, realClock{})
+}
+
+func newWithClock(rate float64, burst int, baseDelay, maxDelay time.Duration,
+	clock Clock) RateLimiter {
+	ret := &rateLimiterImpl{
+		ask:    make(chan string),
+		forget: make(chan string),
+		get:    make(chan string),
+		stop:   make(chan struct{}),
+	}
+	go ret.run(rate, burst, baseDelay, maxDelay, clock)
+	return ret
+}
+
+// delayFor returns the backoff delay for a key that has failed n
+// times before, doubling baseDelay on each failure up to maxDelay.
+func delayFor(n int, baseDelay, maxDelay time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	// baseDelay<<n overflows int64 once n plus baseDelay's own bit
+	// length exceeds 63 bits; for large baseDelay values that can
+	// happen well before n reaches 63, and the wrapped result can
+	// land back inside (0, maxDelay] and look like a valid, much too
+	// small delay instead of an overflow. So bound n by baseDelay's
+	// bit length rather than a fixed constant, and never perform the
+	// shift at all once it could overflow.
+	if n > 63-bits.Len64(uint64(baseDelay)) {
+		return maxDelay
+	}
+	d := baseDelay << n
+	if d <= 0 || d > maxDelay {
+		return maxDelay
+	}
+	return d
 }
 
-// AfterOneSecondIdle returns a RateLimiter that sends a tick after
-// the caller is idle for one second. That is, after one second
-// without a call to AskTick.
-func AfterOneSecondIdle() RateLimiter {
-	ret := &rateLimiterImpl{make(chan struct{}), make(chan struct{}), make(chan struct{})}
-	go func() {
-		timer := time.NewTimer(1 * time.Second)
-		timer.Stop()
-		var tick chan struct{}
-		for {
-			select {
-			case <-ret.stop:
-				return
-			case <-ret.ask:
-				// We can stop multiple times, so don't use the return from Stop.
-				timer.Stop()
-				select {
-				case <-timer.C:
-				default:
-				}
-				timer.Reset(1 * time.Second)
-			case <-timer.C:
-				// Enable sending on the next loop iteration
-				tick = ret.tick
-			case tick <- struct{}{}:
-				// Disable sending on the next loop iteration
-				tick = nil
+// earliestPending returns the key with the smallest readyAt among
+// pending, or ok=false if pending is empty.
+func earliestPending(pending map[string]struct{}, states map[string]*keyState) (
+	key string, readyAt time.Time, ok bool) {
+	for k := range pending {
+		at := states[k].readyAt
+		if !ok || at.Before(readyAt) {
+			key, readyAt, ok = k, at, true
+		}
+	}
+	return
+}
+
+func (rl *rateLimiterImpl) run(rate float64, burst int, baseDelay, maxDelay time.Duration,
+	clock Clock) {
+	pending := map[string]struct{}{}
+	states := map[string]*keyState{}
+	tokens := float64(burst)
+	lastRefill := clock.Now()
+
+	refill := func() {
+		now := clock.Now()
+		tokens += now.Sub(lastRefill).Seconds() * rate
+		if tokens > float64(burst) {
+			tokens = float64(burst)
+		}
+		lastRefill = now
+	}
+
+	var waitTimer *time.Timer
+	for {
+		if waitTimer != nil {
+			waitTimer.Stop()
+			waitTimer = nil
+		}
+
+		refill()
+
+		key, readyAt, hasPending := earliestPending(pending, states)
+
+		var out chan string
+		var timerC <-chan time.Time
+		if hasPending {
+			now := clock.Now()
+			switch {
+			case readyAt.After(now):
+				waitTimer = time.NewTimer(readyAt.Sub(now))
+				timerC = waitTimer.C
+			case tokens >= 1:
+				out = rl.get
+			default:
+				// The key's backoff is done, but there is no token
+				// left. Wake up once the bucket has refilled enough.
+				waitTimer = time.NewTimer(time.Duration((1 - tokens) / rate * float64(time.Second)))
+				timerC = waitTimer.C
 			}
 		}
-	}()
-	return ret
+
+		select {
+		case <-rl.stop:
+			if waitTimer != nil {
+				waitTimer.Stop()
+			}
+			close(rl.get)
+			return
+		case k := <-rl.ask:
+			if _, alreadyPending := pending[k]; alreadyPending {
+				// Already scheduled to be delivered by Get; don't
+				// compound the backoff for a key that hasn't failed
+				// again, just re-asked.
+				break
+			}
+			s, ok := states[k]
+			if !ok {
+				s = &keyState{}
+				states[k] = s
+			}
+			s.readyAt = clock.Now().Add(delayFor(s.failures, baseDelay, maxDelay))
+			s.failures++
+			pending[k] = struct{}{}
+		case k := <-rl.forget:
+			delete(states, k)
+			delete(pending, k)
+		case <-timerC:
+			// Re-evaluate on the next iteration, the key may now be ready.
+		case out <- key:
+			tokens--
+			delete(pending, key)
+		}
+	}
 }
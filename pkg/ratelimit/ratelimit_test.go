@@ -0,0 +1,176 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose Now is advanced explicitly by tests, so
+// backoff and token bucket behavior can be exercised without
+// depending on real time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(rate float64, burst int, baseDelay, maxDelay time.Duration) (
+	RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	return newWithClock(rate, burst, baseDelay, maxDelay, clock), clock
+}
+
+func get(t *testing.T, rl RateLimiter) string {
+	t.Helper()
+	done := make(chan string, 1)
+	go func() {
+		key, ok := rl.Get()
+		if !ok {
+			close(done)
+			return
+		}
+		done <- key
+	}()
+	select {
+	case key, ok := <-done:
+		if !ok {
+			t.Fatal("Get returned ok=false")
+		}
+		return key
+	case <-time.After(time.Second):
+		t.Fatal("Get did not return in time")
+		return ""
+	}
+}
+
+func TestImmediateWhenTokenAvailable(t *testing.T) {
+	rl, _ := newTestLimiter(1, 1, time.Millisecond, time.Second)
+	defer rl.Stop()
+
+	rl.AskTickFor("a")
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+}
+
+// TestBackoffDoublesUntilForget exercises the real clock with a tiny
+// baseDelay: each retry should take roughly twice as long as the
+// previous one, and Forget should reset that back to zero.
+func TestBackoffDoublesUntilForget(t *testing.T) {
+	const baseDelay = 20 * time.Millisecond
+	rl := New(1000, 1000, baseDelay, time.Second)
+	defer rl.Stop()
+
+	rl.AskTickFor("a")
+	start := time.Now()
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+	if elapsed := time.Since(start); elapsed > baseDelay {
+		t.Errorf("first ask should not be delayed, took %s", elapsed)
+	}
+
+	// The second ask should be delayed by delayFor(1), 2*baseDelay, so
+	// by at least baseDelay.
+	rl.AskTickFor("a")
+	start = time.Now()
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+	if elapsed := time.Since(start); elapsed < baseDelay {
+		t.Errorf("second ask should be delayed by ~%s, took %s", baseDelay, elapsed)
+	}
+
+	// The third ask doubles that again, to 4*baseDelay, so it takes
+	// longer than the second ask's 2*baseDelay could.
+	rl.AskTickFor("a")
+	start = time.Now()
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+	if elapsed := time.Since(start); elapsed < 3*baseDelay {
+		t.Errorf("third ask should be delayed by ~%s, took %s", 4*baseDelay, elapsed)
+	}
+
+	rl.Forget("a")
+	rl.AskTickFor("a")
+	start = time.Now()
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+	if elapsed := time.Since(start); elapsed > baseDelay {
+		t.Errorf("Forget did not reset the backoff, took %s", elapsed)
+	}
+}
+
+// TestRepeatedAskBeforeGetDoesNotCompoundBackoff guards against
+// ordinary reconciliation churn (several AskTickFor calls for a key
+// that hasn't been delivered by Get yet, let alone failed) being
+// mistaken for repeated failures and pushed out by backoff.
+func TestRepeatedAskBeforeGetDoesNotCompoundBackoff(t *testing.T) {
+	const baseDelay = 20 * time.Millisecond
+	rl := New(1000, 1000, baseDelay, time.Second)
+	defer rl.Stop()
+
+	for i := 0; i < 6; i++ {
+		rl.AskTickFor("a")
+	}
+
+	start := time.Now()
+	if key := get(t, rl); key != "a" {
+		t.Errorf("got %q, want %q", key, "a")
+	}
+	if elapsed := time.Since(start); elapsed > baseDelay {
+		t.Errorf("repeated AskTickFor before Get compounded the backoff, took %s", elapsed)
+	}
+}
+
+// TestDelayForNeverOverflowsBelowMaxDelay checks that delayFor always
+// either returns maxDelay or a value in (0, maxDelay], for every n up
+// to well past where baseDelay<<n would wrap around int64, across a
+// range of baseDelay magnitudes, so a wrap into a zero, negative or
+// too large delay shows up. A wrap into a small positive value passes
+// this check; TestDelayForDoesNotWrapAroundForLargeBaseDelay covers
+// that case.
+func TestDelayForNeverOverflowsBelowMaxDelay(t *testing.T) {
+	const maxDelay = 1 << 60
+	for baseDelay := time.Duration(1); baseDelay < 1<<55; baseDelay = baseDelay*31 + 12345 {
+		for n := 1; n < 70; n++ {
+			d := delayFor(n, baseDelay, maxDelay)
+			if d != maxDelay && (d <= 0 || d > maxDelay) {
+				t.Errorf("delayFor(%d, %d, %d) = %d, want maxDelay or a value in (0, maxDelay]",
+					n, baseDelay, time.Duration(maxDelay), d)
+			}
+		}
+	}
+}
+
+// TestDelayForDoesNotWrapAroundForLargeBaseDelay is a direct
+// regression case for one combination that used to wrap the int64
+// shift back into a small, valid-looking delay instead of returning
+// maxDelay: the old overflow guard only caught n >= 63, but
+// baseDelay=12345 shifted by 52-54 already wraps well before that.
+func TestDelayForDoesNotWrapAroundForLargeBaseDelay(t *testing.T) {
+	const baseDelay = 12345 * time.Nanosecond
+	const maxDelay = 1 << 60 * time.Nanosecond
+	for _, n := range []int{52, 53, 54} {
+		if d := delayFor(n, baseDelay, maxDelay); d != maxDelay {
+			t.Errorf("delayFor(%d, %d, %d) = %d, want maxDelay", n, baseDelay, maxDelay, d)
+		}
+	}
+}
+
+func TestStopUnblocksGet(t *testing.T) {
+	rl, _ := newTestLimiter(1, 1, time.Millisecond, time.Second)
+	rl.Stop()
+
+	if key, ok := rl.Get(); ok {
+		t.Errorf("expected ok=false after Stop, got key %q", key)
+	}
+}